@@ -3,49 +3,102 @@ package avl
 import (
 	"cmp"
 	"fmt"
-
-	"github.com/lvtuwjl/tungdb/tung/kv"
+	"iter"
 )
 
+// Node 平衡二叉树的节点
 type Node[K cmp.Ordered, V any] struct {
 	Key    K
 	Value  V
-	Status kv.Status
 	Height int
-	Left   *Node[K, V]
-	Right  *Node[K, V]
+	// 子树中的节点数量，包括节点本身
+	Size  int
+	Left  *Node[K, V]
+	Right *Node[K, V]
 }
 
+// Tree 平衡二叉树，key 不重复，零值可以直接使用，不是并发安全的
 type Tree[K cmp.Ordered, V any] struct {
 	root *Node[K, V]
+	size int
+}
+
+// Len 元素数量
+func (t *Tree[K, V]) Len() int {
+	return t.size
 }
 
-func (t *Tree[T, V]) Insert(key T, value V) {
+// Insert 插入元素，key 已存在时什么都不做并返回 false
+func (t *Tree[T, V]) Insert(key T, value V) bool {
 	// 从根节点开始插入数据
 	// 根节点在动态变化,所以需要不断刷新
-	t.root = t.root.insert(key, value)
+	var inserted bool
+	t.root, _, inserted = t.root.insert(key, value, false)
+	if inserted {
+		t.size++
+	}
+	return inserted
+}
+
+// Upsert 插入或替换元素，返回被替换的旧值
+func (t *Tree[K, V]) Upsert(key K, value V) (V, bool) {
+	root, old, inserted := t.root.insert(key, value, true)
+	t.root = root
+	if inserted {
+		t.size++
+	}
+	return old, !inserted
 }
 
-func (n *Node[K, V]) insert(key K, value V) *Node[K, V] {
+// Update 替换已存在的元素，key 不存在时返回 false
+func (t *Tree[K, V]) Update(key K, value V) bool {
+	node := t.root.search(key)
+	if node == nil {
+		return false
+	}
+	node.Value = value
+	return true
+}
+
+// Delete 删除元素，返回被删除的值
+func (t *Tree[K, V]) Delete(key K) (V, bool) {
+	root, old, deleted := t.root.delete(key)
+	t.root = root
+	if deleted {
+		t.size--
+	}
+	return old, deleted
+}
+
+// 插入节点，返回插入后的子树根节点、被替换的旧值，以及是否插入了新节点
+// key 已存在时，replace 为 true 则替换值，否则什么都不做
+func (n *Node[K, V]) insert(key K, value V, replace bool) (*Node[K, V], V, bool) {
+	var old V
 	// 如果节点为空 则初始化该节点
 	if n == nil {
 		return &Node[K, V]{
 			Key:    key,
 			Value:  value,
 			Height: 1,
-		}
+			Size:   1,
+		}, old, true
 	}
 
-	// 如果值重复 则什么都不做
+	// 如果值重复 则按需替换，树的结构不变
 	if n.Key == key {
-		return n
+		old = n.Value
+		if replace {
+			n.Value = value
+		}
+		return n, old, false
 	}
 
 	// 辅助变量 用于存储旋转后子树根节点
 	var newNode *Node[K, V]
+	var inserted bool
 	if key > n.Key {
 		// 插入的值大于当前节点值,从右子树插入
-		n.Right = n.Right.insert(key, value)
+		n.Right, old, inserted = n.Right.insert(key, value, replace)
 		// 计算插入节点后当前节点的平衡因子
 		// 按照平衡二叉树的特征,平衡因子绝对值不能大于1
 		bf := n.BalanceFactor()
@@ -61,7 +114,7 @@ func (n *Node[K, V]) insert(key K, value V) *Node[K, V] {
 		}
 	} else {
 		// 插入的值小于当前节点值,需要从左子树插入
-		n.Left = n.Left.insert(key, value)
+		n.Left, old, inserted = n.Left.insert(key, value, replace)
 		bf := n.BalanceFactor()
 		// 左子树的高度变高了,导致左子树-右子树的高度从1变成了2
 		if bf == 2 {
@@ -77,60 +130,264 @@ func (n *Node[K, V]) insert(key K, value V) *Node[K, V] {
 
 	if newNode == nil {
 		n.UpdateHeight()
-		return n
+		return n, old, inserted
 	} else {
 		newNode.UpdateHeight()
-		return newNode
+		return newNode, old, inserted
 	}
 }
 
-func (n *Node[K, V]) delete(key K) *Node[K, V] {
-	// 如果节点为空 则初始化该节点
+// 删除节点，返回删除后的子树根节点、被删除的值，以及是否删除了节点
+func (n *Node[K, V]) delete(key K) (*Node[K, V], V, bool) {
+	var old V
+	// 节点为空 说明不存在
 	if n == nil {
-		return nil
+		return nil, old, false
 	}
 
-	// 如果值重复 则什么都不做
-	if n.Key == key {
-		n.Status = kv.StatusDeleted
-		return n
+	var deleted bool
+	switch {
+	case key > n.Key:
+		n.Right, old, deleted = n.Right.delete(key)
+	case key < n.Key:
+		n.Left, old, deleted = n.Left.delete(key)
+	default:
+		old, deleted = n.Value, true
+		// 只有一个子节点时，用子节点代替当前节点
+		if n.Left == nil {
+			return n.Right, old, true
+		}
+		if n.Right == nil {
+			return n.Left, old, true
+		}
+		// 有两个子节点时，用右子树的最小节点代替当前节点
+		min := n.Right.min()
+		n.Key, n.Value = min.Key, min.Value
+		n.Right, _, _ = n.Right.delete(min.Key)
 	}
+	if !deleted {
+		return n, old, false
+	}
+	return n.rebalance(), old, true
+}
 
+// 子树高度变化后重新平衡，返回平衡后的子树根节点
+func (n *Node[K, V]) rebalance() *Node[K, V] {
+	n.UpdateHeight()
+	switch bf := n.BalanceFactor(); {
+	case bf == 2:
+		// 左子树过高，左子节点偏右时需要先左后右双旋
+		if n.Left.BalanceFactor() < 0 {
+			return LeftRightRotate(n)
+		}
+		return RightRotate(n)
+	case bf == -2:
+		// 右子树过高，右子节点偏左时需要先右后左双旋
+		if n.Right.BalanceFactor() > 0 {
+			return RightLeftRotate(n)
+		}
+		return LeftRotate(n)
+	}
 	return n
 }
 
-func (n *Node[K, V]) update(key K, value V) *Node[K, V] {
-	// 如果节点为空 则初始化该节点
+func (n *Node[K, V]) search(key K) *Node[K, V] {
+	// 节点为空 说明不存在
 	if n == nil {
-		return &Node[K, V]{
-			Key:    key,
-			Value:  value,
-			Height: 1,
-		}
+		return nil
 	}
 
-	// 如果值重复 则什么都不做
+	// 找到
 	if n.Key == key {
 		return n
 	}
 
+	// 递归查找
+	if key > n.Key {
+		return n.Right.search(key)
+	}
+	return n.Left.search(key)
+}
+
+func (n *Node[K, V]) min() *Node[K, V] {
+	for n != nil && n.Left != nil {
+		n = n.Left
+	}
 	return n
 }
 
-func (n *Node[K, V]) search(key K) *Node[K, V] {
-	// 如果节点为空 则初始化该节点
+func (n *Node[K, V]) max() *Node[K, V] {
+	for n != nil && n.Right != nil {
+		n = n.Right
+	}
+	return n
+}
+
+// Get 查找 key 对应的值
+func (t *Tree[K, V]) Get(key K) (V, bool) {
+	node := t.root.search(key)
+	if node == nil {
+		var zero V
+		return zero, false
+	}
+	return node.Value, true
+}
+
+// Min 最小的元素
+func (t *Tree[K, V]) Min() (K, V, bool) {
+	return t.root.min().entry()
+}
+
+// Max 最大的元素
+func (t *Tree[K, V]) Max() (K, V, bool) {
+	return t.root.max().entry()
+}
+
+// Floor 小于等于 key 的最大元素
+func (t *Tree[K, V]) Floor(key K) (K, V, bool) {
+	return t.root.floor(key).entry()
+}
+
+// Ceiling 大于等于 key 的最小元素
+func (t *Tree[K, V]) Ceiling(key K) (K, V, bool) {
+	return t.root.ceiling(key).entry()
+}
+
+func (n *Node[K, V]) floor(key K) *Node[K, V] {
+	var found *Node[K, V]
+	for n != nil {
+		if n.Key == key {
+			return n
+		}
+		if n.Key < key {
+			found = n
+			n = n.Right
+		} else {
+			n = n.Left
+		}
+	}
+	return found
+}
+
+func (n *Node[K, V]) ceiling(key K) *Node[K, V] {
+	var found *Node[K, V]
+	for n != nil {
+		if n.Key == key {
+			return n
+		}
+		if n.Key > key {
+			found = n
+			n = n.Left
+		} else {
+			n = n.Right
+		}
+	}
+	return found
+}
+
+func (n *Node[K, V]) entry() (K, V, bool) {
 	if n == nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	return n.Key, n.Value, true
+}
+
+// Rank 小于 key 的元素数量，即 key 在升序中的位置
+func (t *Tree[K, V]) Rank(key K) int {
+	return t.root.rank(key)
+}
+
+// Select 升序中的第 k 个元素，k 从 0 开始
+func (t *Tree[K, V]) Select(k int) (K, V, bool) {
+	return t.root.selectAt(k).entry()
+}
+
+// CountRange [lo, hi) 范围内的元素数量
+func (t *Tree[K, V]) CountRange(lo K, hi K) int {
+	return t.root.countRange(lo, hi)
+}
+
+func (n *Node[K, V]) rank(key K) int {
+	rank := 0
+	for n != nil {
+		if key > n.Key {
+			rank += n.Left.size() + 1
+			n = n.Right
+		} else {
+			n = n.Left
+		}
+	}
+	return rank
+}
+
+func (n *Node[K, V]) selectAt(k int) *Node[K, V] {
+	if k < 0 || k >= n.size() {
 		return nil
 	}
+	for {
+		left := n.Left.size()
+		switch {
+		case k < left:
+			n = n.Left
+		case k > left:
+			k -= left + 1
+			n = n.Right
+		default:
+			return n
+		}
+	}
+}
 
-	// 如果值重复 则什么都不做
-	if n.Key == key {
-		return n
+func (n *Node[K, V]) countRange(lo K, hi K) int {
+	if hi <= lo {
+		return 0
 	}
+	return n.rank(hi) - n.rank(lo)
+}
 
-	// 递归查找
+// All 按 key 升序遍历所有元素
+func (t *Tree[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.root.ascend(yield)
+	}
+}
 
-	return n
+// Range 按 key 升序遍历 [from, to) 范围内的元素
+func (t *Tree[K, V]) Range(from K, to K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.root.ascendRange(from, to, yield)
+	}
+}
+
+// Ascend 按 key 升序遍历，fn 返回 false 时停止
+func (t *Tree[K, V]) Ascend(fn func(key K, value V) bool) {
+	t.root.ascend(fn)
+}
+
+func (n *Node[K, V]) ascend(fn func(key K, value V) bool) bool {
+	if n == nil {
+		return true
+	}
+	return n.Left.ascend(fn) && fn(n.Key, n.Value) && n.Right.ascend(fn)
+}
+
+// 只进入可能包含范围内元素的子树
+func (n *Node[K, V]) ascendRange(from K, to K, fn func(key K, value V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.Key >= from && !n.Left.ascendRange(from, to, fn) {
+		return false
+	}
+	if n.Key >= from && n.Key < to && !fn(n.Key, n.Value) {
+		return false
+	}
+	if n.Key < to {
+		return n.Right.ascendRange(from, to, fn)
+	}
+	return true
 }
 
 // BalanceFactor 计算节点平衡因子(即左右子树的高度差)
@@ -153,7 +410,7 @@ func LeftRotate[K cmp.Ordered, V any](node *Node[K, V]) *Node[K, V] {
 	pivot.Left = node    // 左旋后最小不平衡子树根节点node变成pivot的左子节点
 	node.Right = pivotL  // 而pivot 原本的左子节点需要挂载到node节点的右子树上
 
-	// 只有node和pivot的高度改变了
+	// 只有node和pivot的高度和子树大小改变了
 	node.UpdateHeight()
 	pivot.UpdateHeight()
 
@@ -168,7 +425,7 @@ func RightRotate[K cmp.Ordered, V any](node *Node[K, V]) *Node[K, V] {
 	pivot.Right = node    // 左旋后最小不平衡子树根节点node变成pivot的左子节点
 	node.Left = pivotR    // 而pivot 原本的左子节点需要挂载到node节点的右子树上
 
-	// 只有node和pivot的高度改变了
+	// 只有node和pivot的高度和子树大小改变了
 	node.UpdateHeight()
 	pivot.UpdateHeight()
 
@@ -210,6 +467,15 @@ func (n *Node[K, V]) UpdateHeight() {
 
 	// 最终高度要加上节点本身所在的那一层
 	n.Height = maxHeight + 1
+	// 子树大小随高度一起维护，旋转和删除后同样会被更新
+	n.Size = n.Left.size() + n.Right.size() + 1
+}
+
+func (n *Node[K, V]) size() int {
+	if n == nil {
+		return 0
+	}
+	return n.Size
 }
 
 // Traverse 中序遍历平衡二叉树
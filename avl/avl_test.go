@@ -1,6 +1,8 @@
 package avl_test
 
 import (
+	"math/rand"
+	"sort"
 	"testing"
 
 	. "github.com/lvtuwjl/tungdb/tung/avl"
@@ -22,3 +24,222 @@ func TestInsert(t1 *testing.T) {
 	// 14(-1) 24(0) 34(-1) 54(0) 74(-1) 94(-1) 394(0)
 	// 14(-1) 24(0) 34(-1) 394(0) 54(1) 74(1) 94(0)
 }
+
+func TestAgainstMap(t *testing.T) {
+	tree := &Tree[int, int]{}
+	ref := make(map[int]int)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key, value := r.Intn(500), r.Int()
+		switch r.Intn(4) {
+		case 0:
+			_, exists := ref[key]
+			if inserted := tree.Insert(key, value); inserted == exists {
+				t.Fatalf("Insert(%d) = %v, exists %v", key, inserted, exists)
+			}
+			if !exists {
+				ref[key] = value
+			}
+		case 1:
+			old, exists := ref[key]
+			got, replaced := tree.Upsert(key, value)
+			if replaced != exists || got != old {
+				t.Fatalf("Upsert(%d) = %d, %v, want %d, %v", key, got, replaced, old, exists)
+			}
+			ref[key] = value
+		case 2:
+			_, exists := ref[key]
+			if updated := tree.Update(key, value); updated != exists {
+				t.Fatalf("Update(%d) = %v, want %v", key, updated, exists)
+			}
+			if exists {
+				ref[key] = value
+			}
+		default:
+			old, exists := ref[key]
+			got, deleted := tree.Delete(key)
+			if deleted != exists || got != old {
+				t.Fatalf("Delete(%d) = %d, %v, want %d, %v", key, got, deleted, old, exists)
+			}
+			delete(ref, key)
+		}
+		if tree.Len() != len(ref) {
+			t.Fatalf("Len() = %d, want %d", tree.Len(), len(ref))
+		}
+		if i%500 == 0 {
+			checkBalanced(t, tree.Root())
+		}
+	}
+	checkBalanced(t, tree.Root())
+
+	keys := make([]int, 0, len(ref))
+	for key := range ref {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	i := 0
+	for key, value := range tree.All() {
+		if key != keys[i] || value != ref[key] {
+			t.Fatalf("All()[%d] = %d, %d, want %d, %d", i, key, value, keys[i], ref[keys[i]])
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("All() returned %d elements, want %d", i, len(keys))
+	}
+
+	for key := -1; key <= 501; key++ {
+		n, last := 0, key-1
+		for k := range tree.Range(key, key+50) {
+			if k <= last || k >= key+50 {
+				t.Fatalf("Range(%d, %d) returned %d after %d", key, key+50, k, last)
+			}
+			n, last = n+1, k
+		}
+		want := sort.SearchInts(keys, key+50) - sort.SearchInts(keys, key)
+		if n != want {
+			t.Fatalf("Range(%d, %d) returned %d elements, want %d", key, key+50, n, want)
+		}
+
+		j := sort.SearchInts(keys, key+1) - 1
+		if k, v, ok := tree.Floor(key); ok != (j >= 0) || ok && (k != keys[j] || v != ref[k]) {
+			t.Fatalf("Floor(%d) = %d, %v", key, k, ok)
+		}
+		j = sort.SearchInts(keys, key)
+		if k, v, ok := tree.Ceiling(key); ok != (j < len(keys)) || ok && (k != keys[j] || v != ref[k]) {
+			t.Fatalf("Ceiling(%d) = %d, %v", key, k, ok)
+		}
+	}
+	for i, key := range keys {
+		if rank := tree.Rank(key); rank != i {
+			t.Fatalf("Rank(%d) = %d, want %d", key, rank, i)
+		}
+		if k, v, ok := tree.Select(i); !ok || k != key || v != ref[key] {
+			t.Fatalf("Select(%d) = %d, %v, want %d", i, k, ok, key)
+		}
+		if rank := tree.Rank(key + 1); rank != sort.SearchInts(keys, key+1) {
+			t.Fatalf("Rank(%d) = %d", key+1, rank)
+		}
+	}
+	if _, _, ok := tree.Select(len(keys)); ok {
+		t.Fatalf("Select(%d) found an element", len(keys))
+	}
+	for lo := -1; lo <= 501; lo += 7 {
+		for _, hi := range []int{lo - 1, lo, lo + 1, lo + 37, 600} {
+			want := 0
+			if hi > lo {
+				want = sort.SearchInts(keys, hi) - sort.SearchInts(keys, lo)
+			}
+			if n := tree.CountRange(lo, hi); n != want {
+				t.Fatalf("CountRange(%d, %d) = %d, want %d", lo, hi, n, want)
+			}
+		}
+	}
+	if k, _, ok := tree.Min(); !ok || k != keys[0] {
+		t.Fatalf("Min() = %d, %v", k, ok)
+	}
+	if k, _, ok := tree.Max(); !ok || k != keys[len(keys)-1] {
+		t.Fatalf("Max() = %d, %v", k, ok)
+	}
+	for key := range ref {
+		if v, ok := tree.Get(key); !ok || v != ref[key] {
+			t.Fatalf("Get(%d) = %d, %v", key, v, ok)
+		}
+		tree.Delete(key)
+	}
+	if _, _, ok := tree.Min(); ok || tree.Len() != 0 {
+		t.Fatalf("tree is not empty after deleting all keys")
+	}
+}
+
+// 检查高度和平衡因子，返回子树高度
+func checkBalanced(t *testing.T, n *Node[int, int]) int {
+	if n == nil {
+		return 0
+	}
+	left, right := checkBalanced(t, n.Left), checkBalanced(t, n.Right)
+	if n.Left != nil && n.Left.Key >= n.Key || n.Right != nil && n.Right.Key <= n.Key {
+		t.Fatalf("node %d is out of order", n.Key)
+	}
+	height := max(left, right) + 1
+	if n.Height != height {
+		t.Fatalf("node %d has height %d, want %d", n.Key, n.Height, height)
+	}
+	if bf := left - right; bf > 1 || bf < -1 {
+		t.Fatalf("node %d has balance factor %d", n.Key, bf)
+	}
+	size := 1
+	if n.Left != nil {
+		size += n.Left.Size
+	}
+	if n.Right != nil {
+		size += n.Right.Size
+	}
+	if n.Size != size {
+		t.Fatalf("node %d has size %d, want %d", n.Key, n.Size, size)
+	}
+	return height
+}
+
+func TestPersistent(t *testing.T) {
+	var tree Persistent[int, int]
+	ref := make(map[int]int)
+	// 每一步的快照和当时的内容
+	var snapshots []Persistent[int, int]
+	var refs []map[int]int
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 5000; i++ {
+		key := r.Intn(300)
+		if r.Intn(3) == 0 {
+			old, exists := ref[key]
+			var got int
+			var deleted bool
+			tree, got, deleted = tree.Delete(key)
+			if deleted != exists || got != old {
+				t.Fatalf("Delete(%d) = %d, %v, want %d, %v", key, got, deleted, old, exists)
+			}
+			delete(ref, key)
+		} else {
+			tree, _, _ = tree.Upsert(key, i)
+			ref[key] = i
+		}
+		if i%100 == 0 {
+			snapshot := make(map[int]int, len(ref))
+			for k, v := range ref {
+				snapshot[k] = v
+			}
+			snapshots = append(snapshots, tree)
+			refs = append(refs, snapshot)
+		}
+	}
+	snapshots = append(snapshots, tree)
+	refs = append(refs, ref)
+
+	// 之后的修改不影响之前的快照
+	for i, snapshot := range snapshots {
+		checkBalanced(t, snapshot.Root())
+		if snapshot.Len() != len(refs[i]) {
+			t.Fatalf("snapshot %d: Len() = %d, want %d", i, snapshot.Len(), len(refs[i]))
+		}
+		n, last := 0, -1
+		for it := snapshot.Iterator(); it.Next(); n++ {
+			if it.Key() <= last || refs[i][it.Key()] != it.Value() {
+				t.Fatalf("snapshot %d: unexpected %d = %d", i, it.Key(), it.Value())
+			}
+			if k, _, _ := snapshot.Select(n); k != it.Key() || snapshot.Rank(k) != n {
+				t.Fatalf("snapshot %d: Select(%d) = %d, Rank(%d) = %d", i, n, k, it.Key(), snapshot.Rank(it.Key()))
+			}
+			last = it.Key()
+		}
+		if n != len(refs[i]) {
+			t.Fatalf("snapshot %d: iterated %d elements, want %d", i, n, len(refs[i]))
+		}
+	}
+
+	if next, inserted := tree.Insert(-1, 0); !inserted || next.Len() != tree.Len()+1 {
+		t.Fatalf("Insert() of a new key = %v", inserted)
+	}
+	if _, ok := tree.Get(-1); ok {
+		t.Fatal("Insert() modified the original tree")
+	}
+}
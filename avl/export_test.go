@@ -0,0 +1,10 @@
+package avl
+
+// Root 测试中检查树的结构
+func (t *Tree[K, V]) Root() *Node[K, V] {
+	return t.root
+}
+
+func (t Persistent[K, V]) Root() *Node[K, V] {
+	return t.root
+}
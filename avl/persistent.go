@@ -0,0 +1,253 @@
+package avl
+
+import (
+	"cmp"
+	"iter"
+)
+
+// Persistent 持久化（路径复制）的平衡二叉树，零值为空树
+// 修改不会改变原来的树，而是复制被修改的路径，返回与原来的树共享其余节点的新树，
+// 所以保存一个 Persistent 就是一个 O(1) 的快照，可以在修改的同时被并发读取
+type Persistent[K cmp.Ordered, V any] struct {
+	root *Node[K, V]
+	size int
+}
+
+// Len 元素数量
+func (t Persistent[K, V]) Len() int {
+	return t.size
+}
+
+// Get 查找 key 对应的值
+func (t Persistent[K, V]) Get(key K) (V, bool) {
+	_, value, ok := t.root.search(key).entry()
+	return value, ok
+}
+
+// Min 最小的元素
+func (t Persistent[K, V]) Min() (K, V, bool) {
+	return t.root.min().entry()
+}
+
+// Max 最大的元素
+func (t Persistent[K, V]) Max() (K, V, bool) {
+	return t.root.max().entry()
+}
+
+// Floor 小于等于 key 的最大元素
+func (t Persistent[K, V]) Floor(key K) (K, V, bool) {
+	return t.root.floor(key).entry()
+}
+
+// Ceiling 大于等于 key 的最小元素
+func (t Persistent[K, V]) Ceiling(key K) (K, V, bool) {
+	return t.root.ceiling(key).entry()
+}
+
+// Rank 小于 key 的元素数量
+func (t Persistent[K, V]) Rank(key K) int {
+	return t.root.rank(key)
+}
+
+// Select 升序中的第 k 个元素，k 从 0 开始
+func (t Persistent[K, V]) Select(k int) (K, V, bool) {
+	return t.root.selectAt(k).entry()
+}
+
+// CountRange [lo, hi) 范围内的元素数量
+func (t Persistent[K, V]) CountRange(lo K, hi K) int {
+	return t.root.countRange(lo, hi)
+}
+
+// All 按 key 升序遍历所有元素
+func (t Persistent[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.root.ascend(yield)
+	}
+}
+
+// Range 按 key 升序遍历 [from, to) 范围内的元素
+func (t Persistent[K, V]) Range(from K, to K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.root.ascendRange(from, to, yield)
+	}
+}
+
+// Iterator 按 key 升序遍历的迭代器，不需要额外的协程
+func (t Persistent[K, V]) Iterator() *Iterator[K, V] {
+	it := &Iterator[K, V]{}
+	it.pushLeft(t.root)
+	return it
+}
+
+// Insert 插入元素，返回新的树，key 已存在时返回原来的树和 false
+func (t Persistent[K, V]) Insert(key K, value V) (Persistent[K, V], bool) {
+	root, _, inserted := t.root.insertCopy(key, value, false)
+	if !inserted {
+		return t, false
+	}
+	return Persistent[K, V]{root: root, size: t.size + 1}, true
+}
+
+// Upsert 插入或替换元素，返回新的树和被替换的旧值
+func (t Persistent[K, V]) Upsert(key K, value V) (Persistent[K, V], V, bool) {
+	root, old, inserted := t.root.insertCopy(key, value, true)
+	size := t.size
+	if inserted {
+		size++
+	}
+	return Persistent[K, V]{root: root, size: size}, old, !inserted
+}
+
+// Delete 删除元素，返回新的树和被删除的值，key 不存在时返回原来的树
+func (t Persistent[K, V]) Delete(key K) (Persistent[K, V], V, bool) {
+	root, old, deleted := t.root.deleteCopy(key)
+	if !deleted {
+		return t, old, false
+	}
+	return Persistent[K, V]{root: root, size: t.size - 1}, old, true
+}
+
+func (n *Node[K, V]) clone() *Node[K, V] {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
+
+// 复制路径插入节点，返回新的子树根节点、被替换的旧值，以及是否插入了新节点
+// 子树没有变化时返回原来的节点
+func (n *Node[K, V]) insertCopy(key K, value V, replace bool) (*Node[K, V], V, bool) {
+	var old V
+	if n == nil {
+		return &Node[K, V]{
+			Key:    key,
+			Value:  value,
+			Height: 1,
+			Size:   1,
+		}, old, true
+	}
+	if n.Key == key {
+		if !replace {
+			return n, n.Value, false
+		}
+		c := n.clone()
+		c.Value = value
+		return c, n.Value, false
+	}
+
+	var child *Node[K, V]
+	var inserted bool
+	c := n.clone()
+	if key > n.Key {
+		child, old, inserted = n.Right.insertCopy(key, value, replace)
+		if child == n.Right {
+			return n, old, false
+		}
+		c.Right = child
+	} else {
+		child, old, inserted = n.Left.insertCopy(key, value, replace)
+		if child == n.Left {
+			return n, old, false
+		}
+		c.Left = child
+	}
+	return c.rebalanceCopy(), old, inserted
+}
+
+// 复制路径删除节点，key 不存在时返回原来的节点
+func (n *Node[K, V]) deleteCopy(key K) (*Node[K, V], V, bool) {
+	var old V
+	if n == nil {
+		return nil, old, false
+	}
+
+	var child *Node[K, V]
+	var deleted bool
+	switch {
+	case key > n.Key:
+		if child, old, deleted = n.Right.deleteCopy(key); !deleted {
+			return n, old, false
+		}
+		c := n.clone()
+		c.Right = child
+		return c.rebalanceCopy(), old, true
+	case key < n.Key:
+		if child, old, deleted = n.Left.deleteCopy(key); !deleted {
+			return n, old, false
+		}
+		c := n.clone()
+		c.Left = child
+		return c.rebalanceCopy(), old, true
+	}
+
+	// 只有一个子节点时，用子节点代替当前节点
+	if n.Left == nil {
+		return n.Right, n.Value, true
+	}
+	if n.Right == nil {
+		return n.Left, n.Value, true
+	}
+	// 有两个子节点时，用右子树的最小节点代替当前节点
+	min := n.Right.min()
+	c := n.clone()
+	c.Key, c.Value = min.Key, min.Value
+	c.Right, _, _ = n.Right.deleteCopy(min.Key)
+	return c.rebalanceCopy(), n.Value, true
+}
+
+// 重新平衡复制出来的节点 n，旋转前先复制会被修改的子节点，原来的树不受影响
+func (n *Node[K, V]) rebalanceCopy() *Node[K, V] {
+	n.UpdateHeight()
+	switch n.BalanceFactor() {
+	case 2:
+		n.Left = n.Left.clone()
+		if n.Left.BalanceFactor() < 0 {
+			n.Left.Right = n.Left.Right.clone()
+		}
+	case -2:
+		n.Right = n.Right.clone()
+		if n.Right.BalanceFactor() > 0 {
+			n.Right.Left = n.Right.Left.clone()
+		}
+	default:
+		return n
+	}
+	return n.rebalance()
+}
+
+// Iterator 平衡二叉树的中序遍历迭代器
+type Iterator[K cmp.Ordered, V any] struct {
+	stack []*Node[K, V]
+	node  *Node[K, V]
+}
+
+// Next 移动到下一个元素，没有更多元素时返回 false
+func (it *Iterator[K, V]) Next() bool {
+	n := len(it.stack)
+	if n == 0 {
+		it.node = nil
+		return false
+	}
+	it.node = it.stack[n-1]
+	it.stack = it.stack[:n-1]
+	it.pushLeft(it.node.Right)
+	return true
+}
+
+// Key 当前元素的 key
+func (it *Iterator[K, V]) Key() K {
+	return it.node.Key
+}
+
+// Value 当前元素的值
+func (it *Iterator[K, V]) Value() V {
+	return it.node.Value
+}
+
+func (it *Iterator[K, V]) pushLeft(n *Node[K, V]) {
+	for ; n != nil; n = n.Left {
+		it.stack = append(it.stack, n)
+	}
+}
@@ -0,0 +1,106 @@
+// Package bloom 布隆过滤器，SSTable 用它在查找前判断 key 是否可能存在
+//
+// 过滤器的格式为位数组，最后一个字节为哈希函数的个数，
+// 写入磁盘后不能修改哈希算法，否则旧文件中的过滤器会失效
+package bloom
+
+// DefaultBitsPerKey 默认每个 key 占用的位数，误判率约为 1%
+const DefaultBitsPerKey = 10
+
+// Builder 生成布隆过滤器
+type Builder struct {
+	bitsPerKey int
+	hashes     []uint64
+}
+
+// NewBuilder 创建 Builder，bitsPerKey 为每个 key 占用的位数，越大误判率越低
+func NewBuilder(bitsPerKey int) *Builder {
+	if bitsPerKey <= 0 {
+		bitsPerKey = DefaultBitsPerKey
+	}
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+// Add 添加一个 key
+func (b *Builder) Add(key string) {
+	b.hashes = append(b.hashes, hash(key))
+}
+
+// Len 已添加的 key 数量
+func (b *Builder) Len() int {
+	return len(b.hashes)
+}
+
+// Finish 生成过滤器，并清空已添加的 key
+func (b *Builder) Finish() Filter {
+	// k = bitsPerKey * ln2 时误判率最低
+	k := b.bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	bits := len(b.hashes) * b.bitsPerKey
+	// key 很少时误判率会很高，设置一个最小长度
+	if bits < 64 {
+		bits = 64
+	}
+	n := (bits + 7) / 8
+	bits = n * 8
+
+	filter := make([]byte, n+1)
+	filter[n] = byte(k)
+	for _, h := range b.hashes {
+		// 双重哈希，用两个哈希值模拟 k 个哈希函数
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := 0; i < k; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	b.hashes = b.hashes[:0]
+	return filter
+}
+
+// Filter 布隆过滤器
+type Filter []byte
+
+// MayContain key 是否可能存在，返回 false 时 key 一定不存在
+func (f Filter) MayContain(key string) bool {
+	if len(f) < 2 {
+		// 无法识别的过滤器，不能跳过
+		return true
+	}
+	n := len(f) - 1
+	k := int(f[n])
+	if k > 30 {
+		// 保留给以后的格式
+		return true
+	}
+	bits := uint32(n * 8)
+	h := hash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		pos := (h1 + uint32(i)*h2) % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 64 位 FNV-1a，再混合一次使高低 32 位都分布均匀
+func hash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,31 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 10000} {
+		b := NewBuilder(10)
+		for i := 0; i < n; i++ {
+			b.Add(fmt.Sprintf("key%d", i))
+		}
+		f := b.Finish()
+		for i := 0; i < n; i++ {
+			if key := fmt.Sprintf("key%d", i); !f.MayContain(key) {
+				t.Fatalf("n = %d: MayContain(%s) = false", n, key)
+			}
+		}
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if f.MayContain(fmt.Sprintf("missing%d", i)) {
+				falsePositives++
+			}
+		}
+		// 每个 key 10 位时误判率约为 1%
+		if falsePositives > 300 {
+			t.Errorf("n = %d: %d false positives in 10000", n, falsePositives)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package cache 分片的 LRU 缓存，按字节计算容量，用于缓存 SSTable 的数据块，
+// 一个 Cache 可以被多个 SSTable 以及多个数据库共享
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// 分片数量，减少锁竞争
+const numShards = 16
+
+// 每个分片的最小容量，容量较小时减少分片数量，保证单个数据块不会超出分片的容量
+const minShardCapacity = 1 << 20
+
+// Key 缓存的键，FileID 区分不同的文件，Offset 为块在文件中的位置
+type Key struct {
+	FileID uint64
+	Offset uint64
+}
+
+// 文件编号在进程内唯一，同一个文件重新打开后使用新的编号，旧的块会被逐渐淘汰
+var lastFileID atomic.Uint64
+
+// NewFileID 分配一个新的文件编号
+func NewFileID() uint64 {
+	return lastFileID.Add(1)
+}
+
+// Stats 缓存的统计
+type Stats struct {
+	// 命中次数
+	Hits uint64
+	// 未命中次数
+	Misses uint64
+	// 缓存的字节数
+	Usage int64
+	// 容量，单位字节
+	Capacity int64
+}
+
+// Cache 分片的 LRU 缓存，并发安全
+type Cache struct {
+	capacity int64
+	shards   []shard
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	items    map[Key]*list.Element
+	// 最近使用的在前面
+	lru list.List
+}
+
+type entry struct {
+	key   Key
+	value []byte
+}
+
+// New 创建容量为 capacity 字节的缓存
+func New(capacity int64) *Cache {
+	n := capacity / minShardCapacity
+	if n > numShards {
+		n = numShards
+	}
+	if n < 1 {
+		n = 1
+	}
+	c := &Cache{capacity: capacity, shards: make([]shard, n)}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / n
+		c.shards[i].items = make(map[Key]*list.Element)
+	}
+	return c
+}
+
+func (c *Cache) shard(key Key) *shard {
+	h := key.FileID*0x9e3779b97f4a7c15 ^ key.Offset
+	h ^= h >> 29
+	return &c.shards[h%uint64(len(c.shards))]
+}
+
+// Get 获取缓存的值，返回的值不能被修改
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	var value []byte
+	e, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(e)
+		// Set 可能同时替换这个值，需要在持有锁时读取
+		value = e.Value.(*entry).value
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return value, true
+}
+
+// Set 放入缓存，之后不能再修改 value
+// 超出分片容量的值不会被缓存，容量不足 16MB 时分片较少，每个分片至少 1MB 或者为全部容量
+func (c *Cache) Set(key Key, value []byte) {
+	s := c.shard(key)
+	charge := int64(len(value))
+	if charge > s.capacity {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		old := e.Value.(*entry)
+		s.usage += charge - int64(len(old.value))
+		old.value = value
+		s.lru.MoveToFront(e)
+	} else {
+		s.items[key] = s.lru.PushFront(&entry{key: key, value: value})
+		s.usage += charge
+	}
+	// 淘汰最久没有使用的
+	for s.usage > s.capacity {
+		e := s.lru.Back()
+		old := e.Value.(*entry)
+		s.lru.Remove(e)
+		delete(s.items, old.key)
+		s.usage -= int64(len(old.value))
+	}
+}
+
+// Stats 返回缓存的统计
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Capacity: c.capacity,
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Usage += s.usage
+		s.mu.Unlock()
+	}
+	return stats
+}
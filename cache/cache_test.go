@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := New(numShards * 100)
+	key := func(i int) Key { return Key{FileID: 1, Offset: uint64(i)} }
+	for i := 0; i < 1000; i++ {
+		c.Set(key(i), make([]byte, 10))
+		// 保持 0 一直被使用
+		if _, ok := c.Get(key(0)); !ok {
+			t.Fatalf("key 0 was evicted after %d sets", i)
+		}
+	}
+	stats := c.Stats()
+	if stats.Usage > stats.Capacity {
+		t.Fatalf("Usage() = %d exceeds capacity %d", stats.Usage, stats.Capacity)
+	}
+	if _, ok := c.Get(key(1)); ok {
+		t.Fatal("key 1 should have been evicted")
+	}
+	if _, ok := c.Get(key(999)); !ok {
+		t.Fatal("key 999 should be cached")
+	}
+	if stats := c.Stats(); stats.Hits != 1001 || stats.Misses != 1 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+	// 超出容量的值不缓存
+	c.Set(key(2000), make([]byte, numShards*100+1))
+	if _, ok := c.Get(key(2000)); ok {
+		t.Fatal("an oversized value was cached")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c := New(1 << 16)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := Key{FileID: uint64(g), Offset: uint64(i % 100)}
+				if _, ok := c.Get(key); !ok {
+					c.Set(key, make([]byte, 64))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Hits+stats.Misses != 8000 || stats.Usage > stats.Capacity {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+}
+
+// 并发地读取和填充同一个块
+func TestConcurrentSameKey(t *testing.T) {
+	c := New(1 << 20)
+	key := Key{FileID: 1, Offset: 0}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if value, ok := c.Get(key); !ok || len(value) != 64 {
+					c.Set(key, make([]byte, 64))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Usage != 64 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+}
+
+// 容量较小时仍然可以缓存常见大小的数据块
+func TestSmallCapacity(t *testing.T) {
+	for _, capacity := range []int64{16 << 10, 256 << 10, 4 << 20, 64 << 20} {
+		c := New(capacity)
+		for i := 0; i < 4; i++ {
+			key := Key{FileID: 1, Offset: uint64(i) << 12}
+			c.Set(key, make([]byte, 4<<10))
+			if _, ok := c.Get(key); !ok {
+				t.Fatalf("capacity %d: a 4KB block was not cached", capacity)
+			}
+		}
+		if stats := c.Stats(); stats.Usage > capacity {
+			t.Fatalf("capacity %d: Stats() = %+v", capacity, stats)
+		}
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"time"
 
 	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/memtable"
 )
 
+// 默认允许等待持久化的不可变内存表数量
+const defaultMaxImmutableMemtables = 4
+
 func Check() {
 	con := config.GetConfig()
 	ticker := time.Tick(time.Duration(con.CheckInterval) * time.Second)
@@ -15,21 +19,141 @@ func Check() {
 		// 检查内存
 		checkMemory()
 		// 检查压缩数据库文件
-		database.TableTree.Check()
+		compactTables()
 	}
 }
 
 func checkMemory() {
 	con := config.GetConfig()
-	count := database.MemoryTree.Size()
-	if count < con.Threshold {
+	database.mu.RLock()
+	tree := database.MemoryTree
+	full := memtable.Full(tree, con.Threshold, con.MemtableSize)
+	database.mu.RUnlock()
+	if !full {
+		return
+	}
+	swapMemory(tree)
+}
+
+// 交换内存，同时切换 WAL 段，之后的写入都进入新的内存表和新的段
+// old 是调用方检查过的内存表，加锁后它已经被其他写入者交换时直接返回，避免产生空的不可变内存表
+func swapMemory(old memtable.Memtable) {
+	// 在加锁之前创建，WriteBufferManager 等待时会获取 database.mu
+	tree := newMemtable()
+	database.mu.Lock()
+	if database.MemoryTree != old {
+		database.mu.Unlock()
+		if wbm := config.GetConfig().WriteBufferManager; wbm != nil {
+			wbm.Unregister(tree)
+		}
 		return
 	}
-	// 交互内存
 	log.Println("Compressing memory")
-	tmpTree := database.MemoryTree.Swap()
+	database.immutables = append(database.immutables, immutable{
+		tree:    database.MemoryTree,
+		segment: database.Wal.Rotate(),
+	})
+	database.MemoryTree = tree
+	database.mu.Unlock()
+
+	// 由后台线程将内存表存储到 SsTable 中
+	select {
+	case database.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// 创建一个新的内存表，并交给 WriteBufferManager 统计
+func newMemtable() memtable.Memtable {
+	con := config.GetConfig()
+	tree := memtable.New(con.MemtableType)
+	if wbm := con.WriteBufferManager; wbm != nil {
+		wbm.Register(tree)
+	}
+	return tree
+}
+
+// 后台线程，按从旧到新的顺序持久化不可变内存表
+// 持有启动时的数据库实例，不再读取全局变量
+func flushWorker(db *Database) {
+	for range db.flushCh {
+		for flushImmutable(db) {
+		}
+	}
+}
+
+// 持久化最旧的不可变内存表，没有需要持久化的内存表时返回 false
+func flushImmutable(db *Database) bool {
+	db.mu.RLock()
+	if len(db.immutables) == 0 {
+		db.mu.RUnlock()
+		return false
+	}
+	imm := db.immutables[0]
+	db.mu.RUnlock()
+
+	db.bgMu.Lock()
+	db.TableTree.CreateTableFrom(imm.tree.Iterator())
+	db.bgMu.Unlock()
 
-	// 将内存表存储到 SsTable 中
-	database.TableTree.CreateNewTable(tmpTree.GetValues())
-	database.Wal.Reset()
+	// SSTable 可以被查询后再移除内存表，唤醒等待的写入
+	db.mu.Lock()
+	db.immutables = db.immutables[1:]
+	db.mu.Unlock()
+	db.stall.Broadcast()
+
+	if wbm := config.GetConfig().WriteBufferManager; wbm != nil {
+		wbm.Unregister(imm.tree)
+	}
+
+	// SSTable 落盘后才能删除对应的 WAL 段
+	db.Wal.Reset(imm.segment)
+	return true
+}
+
+// 压缩数据库文件，不能与内存表的持久化同时进行
+func compactTables() {
+	database.bgMu.Lock()
+	defer database.bgMu.Unlock()
+	database.TableTree.Check()
+}
+
+// 不可变内存表过多时阻塞写入，直到后台线程持久化了足够多的内存表
+// 调用方需持有 database.mu 的读锁
+func waitForFlush() {
+	limit := config.GetConfig().MaxImmutableMemtables
+	if limit <= 0 {
+		limit = defaultMaxImmutableMemtables
+	}
+	for len(database.immutables) > limit {
+		database.stall.Wait()
+	}
+}
+
+// 写入前调用，不能持有 database.mu
+// 按字节限制内存表时，当前内存表写满后立即交换；
+// 所有内存表占用的内存超过 WriteBufferManager 的上限时，持久化当前内存表，并等待后台线程释放内存
+func throttleWrites() {
+	con := config.GetConfig()
+	if con.MemtableSize > 0 {
+		checkMemory()
+	}
+	wbm := con.WriteBufferManager
+	if wbm == nil || !wbm.Exceeded() {
+		return
+	}
+	// 当前内存表占用较多时才交换，避免产生大量很小的内存表
+	database.mu.RLock()
+	tree := database.MemoryTree
+	bytes := tree.ApproximateBytes()
+	database.mu.RUnlock()
+	if bytes >= wbm.Capacity()/8 {
+		swapMemory(tree)
+	}
+	// 没有等待持久化的内存表时不会再释放内存，不再等待
+	wbm.Wait(func() bool {
+		database.mu.RLock()
+		defer database.mu.RUnlock()
+		return len(database.immutables) == 0
+	})
 }
@@ -0,0 +1,121 @@
+package tung
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+)
+
+// 持久化完成之前，不可变内存表仍然可以被查询，对应的 WAL 段也不能删除
+func TestImmutableBeforeFlush(t *testing.T) {
+	dir := t.TempDir()
+	startTestDB(t, config.Config{DataDir: dir})
+	Set("a", 1)
+
+	// 持有 bgMu 阻塞后台线程的持久化
+	database.bgMu.Lock()
+	swapMemory(database.MemoryTree)
+	database.mu.RLock()
+	count := len(database.immutables)
+	database.mu.RUnlock()
+	if count != 1 {
+		database.bgMu.Unlock()
+		t.Fatalf("%d immutables, want 1", count)
+	}
+	v, ok, _ := Get[int]("a")
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	_, segErr := os.Stat(filepath.Join(dir, "000001.log"))
+	database.bgMu.Unlock()
+	if !ok || v != 1 {
+		t.Fatalf("a = %d, %v before the flush", v, ok)
+	}
+	if len(tables) != 0 {
+		t.Fatalf("tables = %v before the flush", tables)
+	}
+	if segErr != nil {
+		t.Fatalf("the segment was removed before the flush: %v", segErr)
+	}
+
+	waitForImmutables(0)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(filepath.Join(dir, "000001.log")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the segment was not removed after the flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.db")); len(tables) == 0 {
+		t.Fatal("the segment was removed without a table")
+	}
+	if v, ok, _ := Get[int]("a"); !ok || v != 1 {
+		t.Fatalf("a = %d, %v after the flush", v, ok)
+	}
+}
+
+// 不可变内存表超过 MaxImmutableMemtables 时写入等待，持久化后继续
+func TestWriteStall(t *testing.T) {
+	startTestDB(t, config.Config{MaxImmutableMemtables: 2})
+
+	database.bgMu.Lock()
+	for i := 0; i < 3; i++ {
+		setRange(i, i+1)
+		swapMemory(database.MemoryTree)
+	}
+	done := make(chan struct{})
+	go func() {
+		Set("stalled", 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		database.bgMu.Unlock()
+		t.Fatal("the write did not stall")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	database.bgMu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write did not resume after the flush")
+	}
+	if v, ok, _ := Get[int]("stalled"); !ok || v != 1 {
+		t.Fatalf("stalled = %d, %v", v, ok)
+	}
+	for i := 0; i < 3; i++ {
+		if v, ok, _ := Get[int](fmt.Sprintf("key-%05d", i)); !ok || v != i {
+			t.Fatalf("key-%05d = %d, %v", i, v, ok)
+		}
+	}
+}
+
+// 多个写入者同时发现内存表已满时，只交换一次
+func TestConcurrentSwap(t *testing.T) {
+	startTestDB(t, config.Config{Threshold: 1})
+	Set("a", 1)
+
+	database.bgMu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkMemory()
+		}()
+	}
+	wg.Wait()
+	database.mu.RLock()
+	count := len(database.immutables)
+	database.mu.RUnlock()
+	database.bgMu.Unlock()
+	if count != 1 {
+		t.Fatalf("%d immutables, want 1", count)
+	}
+}
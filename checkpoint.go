@@ -0,0 +1,103 @@
+package tung
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/sstable"
+	"github.com/lvtuwjl/tungdb/tung/wal"
+)
+
+// 检查点中记录 WAL 序号和创建时间的文件
+const checkpointFile = "CHECKPOINT"
+
+// Checkpoint 在 dir 中创建数据库的检查点，dir 不能已经存在
+// 检查点包含所有的 SSTable 和尚未删除的 WAL 段，以及其中最后一条写入的序号
+func Checkpoint(dir string) error {
+	if database == nil {
+		return errors.New("tung: database is not started")
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	// 先复制 WAL 段，再链接 SSTable，期间不能持久化内存表或压缩，
+	// 否则 SSTable 中会出现序号大于检查点序号的写入
+	database.bgMu.Lock()
+	seq, err := database.Wal.CopySegments(dir)
+	// 序号不超过 seq 的写入都在此之前完成，之后的写入时间都不早于它
+	created := time.Now()
+	if err == nil {
+		err = database.TableTree.Checkpoint(dir)
+	}
+	database.bgMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data := strconv.FormatUint(seq, 10) + "\n" + created.Format(time.RFC3339Nano) + "\n"
+	err = os.WriteFile(path.Join(dir, checkpointFile), []byte(data), 0666)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created a checkpoint at %s, sequence: %d\r\n", dir, seq)
+	return nil
+}
+
+// 读取检查点的序号和创建时间，旧的检查点没有创建时间
+func readCheckpoint(dir string) (uint64, time.Time, error) {
+	data, err := os.ReadFile(path.Join(dir, checkpointFile))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	seq, err := strconv.ParseUint(lines[0], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("tung: invalid checkpoint %s: %w", dir, err)
+	}
+	var created time.Time
+	if len(lines) > 1 {
+		created, err = time.Parse(time.RFC3339Nano, lines[1])
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("tung: invalid checkpoint %s: %w", dir, err)
+		}
+	}
+	return seq, created, nil
+}
+
+// Restore 由检查点和归档的 WAL 在 targetDir 中恢复数据库，回放到 target 为止，
+// 之后以 targetDir 作为数据目录启动数据库即可，targetDir 不能已经存在。
+// 恢复的数据库会沿用检查点中段的编号，需要配置新的 WALArchiveDir，不能与原来的数据库共用
+func Restore(checkpointDir string, archiveDir string, targetDir string, target wal.RestoreTarget) error {
+	seq, created, err := readCheckpoint(checkpointDir)
+	if err != nil {
+		return err
+	}
+	// 检查点中已经包含了之后的写入，无法恢复到更早的状态
+	if target.Seq != 0 && target.Seq < seq {
+		return fmt.Errorf("tung: target sequence %d is before the checkpoint sequence %d", target.Seq, seq)
+	}
+	if !target.Time.IsZero() && target.Time.Before(created) {
+		return fmt.Errorf("tung: target time %s is before the checkpoint time %s",
+			target.Time.Format(time.RFC3339Nano), created.Format(time.RFC3339Nano))
+	}
+
+	if err := os.Mkdir(targetDir, 0755); err != nil {
+		return err
+	}
+	if err := sstable.CopyTables(checkpointDir, targetDir); err != nil {
+		return err
+	}
+	last, err := wal.Restore(checkpointDir, archiveDir, targetDir, seq, target)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %s from the checkpoint %s, sequence: %d -> %d\r\n", targetDir, checkpointDir, seq, last)
+	return nil
+}
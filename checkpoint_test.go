@@ -0,0 +1,128 @@
+package tung
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/wal"
+)
+
+// 写入 [from, to) 范围内的 key，每个 key 对应一条 WAL 记录
+func setRange(from int, to int) {
+	for i := from; i < to; i++ {
+		Set(fmt.Sprintf("key-%05d", i), i)
+	}
+}
+
+// 持久化当前的内存表，对应的 WAL 段被归档
+func flushMemory() {
+	swapMemory(database.MemoryTree)
+	waitForImmutables(0)
+}
+
+// 以 dir 作为数据目录启动数据库，检查恰好包含 [0, n) 范围内的 key
+func checkRestored(t *testing.T, dir string, n int, total int) {
+	t.Helper()
+	closeTestDB()
+	startTestDB(t, config.Config{DataDir: dir})
+	for i := 0; i < total; i++ {
+		v, ok, _ := Get[int](fmt.Sprintf("key-%05d", i))
+		if i < n && (!ok || v != i) {
+			t.Fatalf("key-%05d = %d, %v, want %d", i, v, ok, i)
+		}
+		if i >= n && ok {
+			t.Fatalf("key-%05d was restored past the target", i)
+		}
+	}
+}
+
+func TestRestoreFromArchive(t *testing.T) {
+	archiveDir := path.Join(t.TempDir(), "archive")
+	startTestDB(t, config.Config{WALArchiveDir: archiveDir})
+
+	setRange(0, 10)
+	flushMemory()
+	checkpointDir := path.Join(t.TempDir(), "checkpoint")
+	if err := Checkpoint(checkpointDir); err != nil {
+		t.Fatal(err)
+	}
+	setRange(10, 20)
+	flushMemory()
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	setRange(20, 30)
+	flushMemory()
+
+	tests := []struct {
+		name    string
+		target  wal.RestoreTarget
+		n       int
+		wantErr bool
+	}{
+		{"seq", wal.RestoreTarget{Seq: 25}, 25, false},
+		{"time", wal.RestoreTarget{Time: at}, 20, false},
+		{"all", wal.RestoreTarget{}, 30, false},
+		{"seq before checkpoint", wal.RestoreTarget{Seq: 5}, 0, true},
+		{"time before checkpoint", wal.RestoreTarget{Time: at.Add(-time.Hour)}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetDir := path.Join(t.TempDir(), "restore")
+			err := Restore(checkpointDir, archiveDir, targetDir, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				checkRestored(t, targetDir, tt.n, 30)
+			}
+		})
+	}
+}
+
+// 写入和持久化同时进行时创建检查点，恢复到检查点的序号时不能包含之后的写入
+func TestCheckpointDuringWrites(t *testing.T) {
+	archiveDir := path.Join(t.TempDir(), "archive")
+	startTestDB(t, config.Config{WALArchiveDir: archiveDir, MemtableSize: 2 << 10})
+
+	var written atomic.Int64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			setRange(i, i+1)
+			written.Store(int64(i + 1))
+		}
+	}()
+	for written.Load() < 200 {
+		time.Sleep(time.Millisecond)
+	}
+	checkpointDir := path.Join(t.TempDir(), "checkpoint")
+	err := Checkpoint(checkpointDir)
+	for n := written.Load(); written.Load() < n+200; {
+		time.Sleep(time.Millisecond)
+	}
+	stop.Store(true)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq, _, err := readCheckpoint(checkpointDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只有一个写入者，第 i 个 key 的序号为 i+1
+	targetDir := path.Join(t.TempDir(), "restore")
+	if err := Restore(checkpointDir, archiveDir, targetDir, wal.RestoreTarget{Seq: seq}); err != nil {
+		t.Fatal(err)
+	}
+	checkRestored(t, targetDir, int(seq), int(written.Load()))
+}
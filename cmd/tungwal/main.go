@@ -0,0 +1,164 @@
+// Command tungwal 查看和校验 WAL 段文件
+//
+// 用法:
+//
+//	tungwal [-format text|json] [-prefix key] [-verify] segment...
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/wal"
+)
+
+var (
+	format = flag.String("format", "text", "output format: text or json (JSON lines)")
+	prefix = flag.String("prefix", "", "only dump records whose key has this prefix")
+	verify = flag.Bool("verify", false, "only verify the files and print a summary")
+)
+
+// 输出的一条记录
+type entry struct {
+	File     string `json:"file"`
+	Offset   int64  `json:"offset"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Op       string `json:"op,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Size     int    `json:"value_size"`
+	Checksum string `json:"checksum"`
+	Error    string `json:"error,omitempty"`
+}
+
+// 一个文件的校验结果
+type summary struct {
+	Records   int
+	Corrupted int
+	Truncated bool
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] segment...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (*format != "text" && *format != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	failed := false
+	for _, file := range flag.Args() {
+		s, err := dump(out, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed = true
+			continue
+		}
+		if s.Corrupted > 0 || s.Truncated {
+			failed = true
+		}
+		if *verify {
+			status := "OK"
+			if s.Corrupted > 0 || s.Truncated {
+				status = "CORRUPTED"
+			}
+			fmt.Fprintf(out, "%s: %s, %d records, %d corrupted, truncated: %v\n",
+				file, status, s.Records, s.Corrupted, s.Truncated)
+		}
+	}
+	if failed {
+		out.Flush()
+		os.Exit(1)
+	}
+}
+
+// 输出一个段文件中的记录
+func dump(out io.Writer, file string) (summary, error) {
+	var s summary
+	f, err := os.Open(file)
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return s, err
+	}
+
+	r := wal.NewReader(f, info.Size())
+	// 旧版本的段文件没有校验和
+	checksum := "ok"
+	if r.Version() < wal.VersionChecksum {
+		checksum = "none"
+	}
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return s, nil
+		}
+
+		e := entry{File: file, Offset: record.Offset, Checksum: checksum}
+		switch {
+		case err == nil:
+			s.Records++
+			if !strings.HasPrefix(record.KV.Key, *prefix) {
+				continue
+			}
+			e.Seq = record.Seq
+			if !record.Time.IsZero() {
+				e.Time = record.Time.Format(time.RFC3339Nano)
+			}
+			e.Op = "put"
+			if record.KV.Status == kv.StatusDeleted {
+				e.Op = "delete"
+			}
+			e.Key = record.KV.Key
+			e.Size = len(record.KV.Value)
+		case errors.Is(err, wal.ErrCorrupted):
+			s.Corrupted++
+			e.Checksum = "corrupted"
+			e.Error = err.Error()
+		case errors.Is(err, wal.ErrTruncated):
+			s.Truncated = true
+			e.Checksum = "truncated"
+			e.Error = err.Error()
+		default:
+			return s, err
+		}
+
+		if !*verify {
+			write(out, e)
+		}
+		if s.Truncated {
+			return s, nil
+		}
+	}
+}
+
+func write(out io.Writer, e entry) {
+	if *format == "json" {
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(out, "%s\n", data)
+		return
+	}
+	if e.Error != "" {
+		fmt.Fprintf(out, "%s@%d\t%s\t%s\n", e.File, e.Offset, e.Checksum, e.Error)
+		return
+	}
+	fmt.Fprintf(out, "%s@%d\tseq=%d\ttime=%s\t%s\t%q\tsize=%d\tchecksum=%s\n",
+		e.File, e.Offset, e.Seq, e.Time, e.Op, e.Key, e.Size, e.Checksum)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/wal"
+)
+
+// 创建一个包含 a、b、c 三条写入的段文件，返回段文件的路径
+func writeSegment(t *testing.T) string {
+	t.Helper()
+	config.Reset()
+	t.Cleanup(config.Reset)
+	dir := t.TempDir()
+	w := &wal.Wal{}
+	w.Init(dir)
+	for _, key := range []string{"a", "b", "c"} {
+		w.Write(kv.KV{Key: key, Value: []byte(`1`), Status: kv.StatusSuccess})
+	}
+	w.Write(kv.KV{Key: "a", Status: kv.StatusDeleted})
+	_ = w.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("segments = %v", segments)
+	}
+	return segments[0]
+}
+
+// 以指定的格式输出段文件
+func dumpFile(t *testing.T, file string, f string) (summary, string) {
+	t.Helper()
+	old := *format
+	*format = f
+	defer func() { *format = old }()
+	var out bytes.Buffer
+	s, err := dump(&out, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, out.String()
+}
+
+// 解析 json 格式的输出
+func parseEntries(t *testing.T, out string) []entry {
+	t.Helper()
+	var entries []entry
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var e entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid json line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestDump(t *testing.T) {
+	clean := writeSegment(t)
+	data, err := os.ReadFile(clean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, out := dumpFile(t, clean, "json")
+	records := parseEntries(t, out)
+	if len(records) != 4 {
+		t.Fatalf("dumped %d records, want 4", len(records))
+	}
+
+	// 破坏 b 的记录头中的序号，校验和不再匹配
+	corrupted := filepath.Join(t.TempDir(), "corrupted.log")
+	bad := append([]byte{}, data...)
+	bad[records[1].Offset+10] ^= 0xff
+	if err := os.WriteFile(corrupted, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// 最后一条记录只写入了一部分
+	truncated := filepath.Join(t.TempDir(), "truncated.log")
+	if err := os.WriteFile(truncated, data[:len(data)-3], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		file      string
+		records   int
+		corrupted int
+		truncated bool
+		checksums []string
+	}{
+		{"clean", clean, 4, 0, false, []string{"ok", "ok", "ok", "ok"}},
+		{"corrupted", corrupted, 3, 1, false, []string{"ok", "corrupted", "ok", "ok"}},
+		{"truncated", truncated, 3, 0, true, []string{"ok", "ok", "ok", "truncated"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/json", func(t *testing.T) {
+			s, out := dumpFile(t, tt.file, "json")
+			if s.Records != tt.records || s.Corrupted != tt.corrupted || s.Truncated != tt.truncated {
+				t.Fatalf("summary = %+v", s)
+			}
+			entries := parseEntries(t, out)
+			if len(entries) != len(tt.checksums) {
+				t.Fatalf("dumped %d entries, want %d", len(entries), len(tt.checksums))
+			}
+			for i, e := range entries {
+				if e.Checksum != tt.checksums[i] || e.File != tt.file {
+					t.Fatalf("entry %d = %+v, want checksum %s", i, e, tt.checksums[i])
+				}
+				if e.Checksum == "ok" && (e.Key == "" || e.Seq == 0 || e.Time == "") {
+					t.Fatalf("entry %d = %+v", i, e)
+				}
+				if e.Checksum != "ok" && e.Error == "" {
+					t.Fatalf("entry %d = %+v, want an error", i, e)
+				}
+			}
+			if tt.name == "clean" && (entries[0].Op != "put" || entries[3].Op != "delete") {
+				t.Fatalf("entries = %+v", entries)
+			}
+		})
+		t.Run(tt.name+"/text", func(t *testing.T) {
+			s, out := dumpFile(t, tt.file, "text")
+			if s.Records != tt.records || s.Corrupted != tt.corrupted || s.Truncated != tt.truncated {
+				t.Fatalf("summary = %+v", s)
+			}
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if len(lines) != len(tt.checksums) {
+				t.Fatalf("dumped %d lines, want %d:\n%s", len(lines), len(tt.checksums), out)
+			}
+			for i, line := range lines {
+				want := "checksum=ok"
+				if tt.checksums[i] != "ok" {
+					want = "\t" + tt.checksums[i] + "\t"
+				}
+				if !strings.HasPrefix(line, tt.file+"@") || !strings.Contains(line, want) {
+					t.Fatalf("line %d = %q, want %q", i, line, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package compress 可插拔的压缩算法，WAL 和 SSTable 在数据中记录算法编号，
+// 读取时根据编号找到对应的算法解压，因此同一个文件中可以混合使用多种算法
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Type 压缩算法编号，会被写入磁盘，已分配的编号不能修改
+type Type byte
+
+const (
+	// None 不压缩
+	None Type = 0
+	// Flate 标准库 compress/flate
+	Flate Type = 1
+	// Zlib 标准库 compress/zlib，在 flate 的基础上增加了头部和 Adler-32 校验
+	Zlib Type = 2
+)
+
+// Compressor 压缩算法
+type Compressor interface {
+	// Type 压缩算法编号
+	Type() Type
+	// Compress 压缩 src，结果追加到 dst 中
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress 解压 src，结果追加到 dst 中
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	mu          sync.RWMutex
+	compressors = map[Type]Compressor{}
+)
+
+func init() {
+	Register(noneCompressor{})
+	Register(flateCompressor{level: flate.DefaultCompression})
+	Register(zlibCompressor{level: zlib.DefaultCompression})
+}
+
+// Register 注册一个压缩算法，编号相同的算法会被替换
+func Register(c Compressor) {
+	mu.Lock()
+	defer mu.Unlock()
+	compressors[c.Type()] = c
+}
+
+// Get 获取指定编号的压缩算法
+func Get(t Type) (Compressor, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := compressors[t]
+	if !ok {
+		return nil, fmt.Errorf("compress: unknown compression type %d", t)
+	}
+	return c, nil
+}
+
+// 不压缩
+type noneCompressor struct{}
+
+func (noneCompressor) Type() Type {
+	return None
+}
+
+func (noneCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// 使用 compress/flate 压缩
+type flateCompressor struct {
+	level int
+}
+
+func (flateCompressor) Type() Type {
+	return Flate
+}
+
+func (c flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 使用 compress/zlib 压缩
+type zlibCompressor struct {
+	level int
+}
+
+func (zlibCompressor) Type() Type {
+	return Zlib
+}
+
+func (c zlibCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := zlib.NewWriterLevel(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
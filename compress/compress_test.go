@@ -0,0 +1,33 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte("tungdb compress "), 100)
+	for _, kind := range []Type{None, Flate, Zlib} {
+		c, err := Get(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := c.Compress([]byte("prefix"), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(compressed, []byte("prefix")) {
+			t.Fatalf("type %d: Compress did not append to dst", kind)
+		}
+		got, err := c.Decompress(nil, compressed[len("prefix"):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("type %d: round trip mismatch", kind)
+		}
+	}
+	if _, err := Get(Type(200)); err == nil {
+		t.Fatal("Get of an unknown type succeeded")
+	}
+}
@@ -1,6 +1,14 @@
 package config
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/lvtuwjl/tungdb/tung/cache"
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/memtable"
+	"github.com/lvtuwjl/tungdb/tung/prefix"
+)
 
 // Config 数据库启动配置
 type Config struct {
@@ -10,25 +18,103 @@ type Config struct {
 	Level0Size int
 	// 每层中 SsTable 表数量的阈值，该层 SsTable 将会被压缩到下一层
 	PartSize int
-	// 内存表的 kv 最大数量，超出这个阈值，内存表将会被保存到 SsTable 中
+	// 压缩生成的单个 SsTable 文件的目标大小，单位字节，超过后写入新的文件，小于等于 0 时使用默认值 64MB
+	TargetFileSize int64
+	// SsTable 数据块的大小，单位字节，小于等于 0 时使用默认值 4KB
+	BlockSize int
+	// SsTable 块中的 key 使用前缀压缩，每隔多少个 key 保存一个完整的 key，小于等于 0 时使用默认值 16；
+	// 越小查找越快，越大文件越小
+	BlockRestartInterval int
+	// 每一层 SsTable 数据块的压缩算法，下标为层数，超出的层使用最后一个，为空时不压缩，
+	// 例如 L0 不压缩，其它层使用 Flate：[]compress.Type{compress.None, compress.Flate}
+	TableCompression []compress.Type
+	// SsTable 数据块缓存的容量，单位字节，小于等于 0 时不缓存；设置了 BlockCache 时忽略
+	BlockCacheSize int64
+	// 共享的数据块缓存，可以在多个数据库之间共享
+	BlockCache *cache.Cache
+	// 最多同时打开的 SsTable 文件数量，超出时关闭最久没有读取的文件，小于等于 0 时不限制
+	MaxOpenFiles int
+	// 关闭 SsTable 文件时是否同时释放它的索引和布隆过滤器，下次读取时重新加载；
+	// 默认保留，查找不存在的 key 时仍然可以用布隆过滤器跳过已经关闭的文件，不需要重新打开
+	DropTableMetadata bool
+	// 是否使用 mmap 读取 SsTable 文件，不支持的平台上或者映射失败时使用 ReadAt
+	MmapReads bool
+	// SsTable 中每个 key 在布隆过滤器中占用的位数，为 0 时使用默认值 10，小于 0 时不生成布隆过滤器
+	BloomBitsPerKey int
+	// 从 key 中提取前缀，SsTable 会为前缀生成布隆过滤器，用于前缀查找，为空时不生成
+	PrefixExtractor prefix.Extractor
+	// 内存表的 kv 最大数量（包括删除标记），超出这个阈值，内存表将会被保存到 SsTable 中
 	Threshold int
+	// 内存表占用内存的上限，单位字节，超出后内存表将会被保存到 SsTable 中，大于 0 时代替 Threshold
+	MemtableSize int64
+	// 限制内存表占用的内存总量，可以在多个数据库之间共享，为空时不限制
+	WriteBufferManager *memtable.WriteBufferManager
+	// 内存表的实现：bst（默认）、avl、skiplist、hash，见 memtable.New
+	MemtableType string
 	// 压缩内存、文件的时间间隔，多久进行一次检查工作
 	CheckInterval int
+	// 等待持久化的不可变内存表超过这个数量时，写入会被阻塞，小于等于 0 时使用默认值 4
+	MaxImmutableMemtables int
+	// WAL 损坏时的恢复策略，默认容忍尾部损坏的记录
+	WALRecoveryMode WALRecoveryMode
+	// 每次提交 WAL 后是否调用 fsync，并发的写入会合并为一次提交
+	WALSync bool
+	// WAL 的压缩算法，组提交时一批写入被压缩为一条记录，默认不压缩
+	WALCompression compress.Type
+	// WAL 归档目录，持久化到 SSTable 后的段被移动到这里而不是删除，用于按时间点恢复
+	WALArchiveDir string
+}
+
+// WALRecoveryMode WAL 文件损坏时的恢复策略
+type WALRecoveryMode int
+
+const (
+	// WALTolerateCorruptedTailRecords 容忍尾部不完整或损坏的记录（崩溃时未写完），中间的损坏则拒绝启动
+	WALTolerateCorruptedTailRecords WALRecoveryMode = iota
+	// WALAbsoluteConsistency 遇到任何错误都拒绝启动
+	WALAbsoluteConsistency
+	// WALPointInTimeRecovery 在第一条损坏的记录处停止，丢弃其后的所有数据
+	WALPointInTimeRecovery
+	// WALSkipAnyCorruptedRecords 跳过所有损坏的记录，尽可能多地恢复数据
+	WALSkipAnyCorruptedRecords
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALTolerateCorruptedTailRecords:
+		return "TolerateCorruptedTailRecords"
+	case WALAbsoluteConsistency:
+		return "AbsoluteConsistency"
+	case WALPointInTimeRecovery:
+		return "PointInTimeRecovery"
+	case WALSkipAnyCorruptedRecords:
+		return "SkipAnyCorruptedRecords"
+	}
+	return "Unknown"
 }
 
 var once *sync.Once = &sync.Once{}
 
-// 常驻内存
-var config Config
+// 常驻内存，替换时整体替换，后台线程读取时不会与 Reset 冲突
+var config atomic.Pointer[Config]
 
 // Init 初始化数据库配置
 func Init(con Config) {
 	once.Do(func() {
-		config = con
+		config.Store(&con)
 	})
 }
 
+// Reset 清除配置，之后可以再次调用 Init，用于测试中以不同的配置启动数据库
+func Reset() {
+	once = &sync.Once{}
+	config.Store(nil)
+}
+
 // GetConfig 获取数据库配置
 func GetConfig() Config {
-	return config
+	if con := config.Load(); con != nil {
+		return *con
+	}
+	return Config{}
 }
@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/lvtuwjl/tungdb/tung/config"
 	"github.com/lvtuwjl/tungdb/tung/kv"
@@ -40,12 +42,15 @@ func Start(con config.Config) {
 	log.Println("Initializing the database")
 	initDatabase(con.DataDir)
 
+	// 启动持久化内存表的后台线程
+	go flushWorker(database)
+
 	// 数据库启动前进行一次数据压缩
 	log.Println("Performing background checks...")
 	// 检查内存
 	checkMemory()
 	// 检查压缩数据库文件
-	database.TableTree.Check()
+	compactTables()
 	// 启动后台线程
 	go Check()
 }
@@ -53,10 +58,11 @@ func Start(con config.Config) {
 // 初始化 Database，从磁盘文件中还原 SSTable、WalF、内存表等
 func initDatabase(dir string) {
 	database = &Database{
-		MemoryTree: &memtable.Tree{},
-		Wal:        &wal.Wal{},
-		TableTree:  &sstable.TableTree{},
+		Wal:       &wal.Wal{},
+		TableTree: &sstable.TableTree{},
+		flushCh:   make(chan struct{}, 1),
 	}
+	database.stall = sync.NewCond(database.mu.RLocker())
 	// 从磁盘文件中恢复数据
 	// 如果目录不存在，则为空数据库
 	if _, err := os.Stat(dir); err != nil {
@@ -67,46 +73,91 @@ func initDatabase(dir string) {
 			panic(err)
 		}
 	}
-	// 从数据目录中，加载 WalF、database 文件
-	// 非空数据库，则开始恢复数据，加载 WalF 和 SSTable 文件
-	memoryTree := database.Wal.Init(dir)
-
-	database.MemoryTree = memoryTree
+	// 从数据目录中，加载 database、WalF 文件
+	// 非空数据库，则开始恢复数据，先加载 SSTable，再回放 WalF
 	log.Println("Loading database...")
 	database.TableTree.Init(dir)
+
+	// WalF 过大时，回放过程中将内存表提前持久化到 SSTable
+	database.Wal.OnFlush = func(tree memtable.Memtable) {
+		database.TableTree.CreateTableFrom(tree.Iterator())
+	}
+	memoryTree := database.Wal.Init(dir)
+	if wbm := config.GetConfig().WriteBufferManager; wbm != nil {
+		wbm.Register(memoryTree)
+	}
+	database.MemoryTree = memoryTree
 }
 
 type Database struct {
 	// 内存表
-	MemoryTree *memtable.Tree
+	MemoryTree memtable.Memtable
 	// SSTable 列表
 	TableTree *sstable.TableTree
 	// WalF 文件句柄
 	Wal *wal.Wal
+	// 等待持久化的不可变内存表，从旧到新排列，持久化之前仍然可以被查询
+	immutables []immutable
+	// 写入时持有读锁，交换内存表和 WAL 段时持有写锁，
+	// 保证每条写入的 WAL 段与内存表属于同一代
+	mu sync.RWMutex
+	// 不可变内存表过多时，写入在这里等待
+	stall *sync.Cond
+	// 通知后台线程持久化不可变内存表
+	flushCh chan struct{}
+	// 持久化内存表和压缩 SSTable 不能同时进行
+	bgMu sync.Mutex
+}
+
+// 不可变内存表
+type immutable struct {
+	tree memtable.Memtable
+	// 内存表的数据所在的最后一个 WAL 段
+	segment uint64
 }
 
 // 数据库，全局唯一实例
 var database *Database
 
-// Get 获取一个元素
-func Get[T any](key string) (T, bool) {
+// Get 获取一个元素，SSTable 中的数据损坏时返回 sstable.ErrCorruption，与 key 不存在区分开
+func Get[T any](key string) (T, bool, error) {
+	return GetWithOptions[T](key, sstable.ReadOptions{})
+}
+
+// GetWithOptions 按照读取选项获取一个元素，SSTable 中的数据损坏时返回 sstable.ErrCorruption
+func GetWithOptions[T any](key string, opts sstable.ReadOptions) (T, bool, error) {
 	log.Print("Get ", key)
-	// 先查内存表
-	value, result := database.MemoryTree.Get(key)
+	var nilV T
+	database.mu.RLock()
+	memoryTree := database.MemoryTree
+	immutables := database.immutables
+	database.mu.RUnlock()
 
+	// 先查内存表，再从新到旧查不可变内存表
+	value, result := memoryTree.Get(key)
+	for i := len(immutables) - 1; i >= 0 && result == kv.StatusNone; i-- {
+		value, result = immutables[i].tree.Get(key)
+	}
 	if result == kv.StatusSuccess {
-		return getInstance[T](value.Value)
+		v, ok := getInstance[T](value.Value)
+		return v, ok, nil
+	}
+	if result == kv.StatusDeleted {
+		return nilV, false, nil
 	}
 
 	// 查 SsTable 文件
 	if database.TableTree != nil {
-		value, result := database.TableTree.Search(key)
+		value, result, err := database.TableTree.SearchWithOptions(key, opts)
+		if err != nil {
+			return nilV, false, err
+		}
 		if result == kv.StatusSuccess {
-			return getInstance[T](value.Value)
+			v, ok := getInstance[T](value.Value)
+			return v, ok, nil
 		}
 	}
-	var nilV T
-	return nilV, false
+	return nilV, false, nil
 }
 
 // Set 插入元素
@@ -118,14 +169,18 @@ func Set[T any](key string, value T) bool {
 		return false
 	}
 
-	_, _ = database.MemoryTree.Put(key, data)
+	throttleWrites()
+	database.mu.RLock()
+	defer database.mu.RUnlock()
+	waitForFlush()
 
-	// 写入 wal.log
+	// 先写入 WAL
 	database.Wal.Write(kv.KV{
 		Key:    key,
 		Value:  data,
-		Status: kv.StatusDeleted,
+		Status: kv.StatusSuccess,
 	})
+	_, _ = database.MemoryTree.Put(key, data)
 	return true
 }
 
@@ -133,15 +188,19 @@ func Set[T any](key string, value T) bool {
 // 返回的 bool 表示是否有旧值，不表示是否删除成功
 func DeleteAndGet[T any](key string) (T, bool) {
 	log.Print("Delete ", key)
-	value, success := database.MemoryTree.Delete(key)
+	throttleWrites()
+	database.mu.RLock()
+	defer database.mu.RUnlock()
+	waitForFlush()
 
+	// 先写入 WAL，键可能只存在于 SSTable 中，删除标记同样需要持久化
+	database.Wal.Write(kv.KV{
+		Key:    key,
+		Value:  nil,
+		Status: kv.StatusDeleted,
+	})
+	value, success := database.MemoryTree.Delete(key)
 	if success {
-		// 写入 wal.log
-		database.Wal.Write(kv.KV{
-			Key:    key,
-			Value:  nil,
-			Status: kv.StatusDeleted,
-		})
 		return getInstance[T](value.Value)
 	}
 	var nilV T
@@ -151,12 +210,66 @@ func DeleteAndGet[T any](key string) (T, bool) {
 // Delete 删除元素
 func Delete[T any](key string) {
 	log.Print("Delete ", key)
-	database.MemoryTree.Delete(key)
+	throttleWrites()
+	database.mu.RLock()
+	defer database.mu.RUnlock()
+	waitForFlush()
+
 	database.Wal.Write(kv.KV{
 		Key:    key,
 		Value:  nil,
 		Status: kv.StatusDeleted,
 	})
+	database.MemoryTree.Delete(key)
+}
+
+// Scan 按 key 升序遍历以 prefix 开头的元素，fn 返回 false 时停止
+// 配置了 PrefixExtractor 时，不包含这个前缀的 SSTable 会被跳过；SSTable 中的数据损坏时返回 sstable.ErrCorruption
+func Scan[T any](prefix string, fn func(key string, value T) bool) error {
+	database.mu.RLock()
+	memoryTree := database.MemoryTree
+	immutables := database.immutables
+	database.mu.RUnlock()
+
+	// 从旧到新合并，新的记录覆盖旧的记录
+	merged := &memtable.Tree{}
+	apply := func(value kv.KV) {
+		if value.Status == kv.StatusDeleted {
+			merged.Delete(value.Key)
+		} else {
+			merged.Put(value.Key, value.Value)
+		}
+	}
+	if err := database.TableTree.ScanPrefix(prefix, apply); err != nil {
+		return err
+	}
+	for _, imm := range immutables {
+		scanMemtable(imm.tree, prefix, apply)
+	}
+	scanMemtable(memoryTree, prefix, apply)
+
+	it := merged.Iterator()
+	for it.Next() {
+		record := it.KV()
+		if record.Status == kv.StatusDeleted {
+			continue
+		}
+		value, _ := getInstance[T](record.Value)
+		if !fn(record.Key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 遍历内存表中以 prefix 开头的记录，包括删除标记
+func scanMemtable(tree memtable.Memtable, prefix string, fn func(kv.KV)) {
+	it := tree.Iterator()
+	for it.Next() {
+		if record := it.KV(); strings.HasPrefix(record.Key, prefix) {
+			fn(record)
+		}
+	}
 }
 
 // 将字节数组转为类型对象
@@ -0,0 +1,142 @@
+package tung
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/sstable"
+)
+
+// 以指定的配置启动一个新的数据库，测试结束时关闭
+// CheckInterval 为 0 时后台检查不会运行，没有设置阈值时内存表只在测试中显式交换
+func startTestDB(t *testing.T, con config.Config) {
+	t.Helper()
+	if con.DataDir == "" {
+		con.DataDir = t.TempDir()
+	}
+	if con.Threshold == 0 && con.MemtableSize == 0 {
+		con.Threshold = math.MaxInt
+	}
+	config.Reset()
+	database = nil
+	Start(con)
+	t.Cleanup(func() {
+		closeTestDB()
+		config.Reset()
+	})
+}
+
+// 以相同的配置重新打开数据库，模拟进程重启
+func reopenTestDB(t *testing.T) {
+	t.Helper()
+	con := config.GetConfig()
+	closeTestDB()
+	config.Reset()
+	Start(con)
+}
+
+// 等待后台线程持久化所有的不可变内存表后关闭 WAL
+func closeTestDB() {
+	if database == nil {
+		return
+	}
+	waitForImmutables(0)
+	database.mu.Lock()
+	_ = database.Wal.Close()
+	database.mu.Unlock()
+	database = nil
+}
+
+// 等待不可变内存表的数量降到 n 以下
+func waitForImmutables(n int) {
+	for {
+		database.mu.RLock()
+		count := len(database.immutables)
+		database.mu.RUnlock()
+		if count <= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeleteAndGetPersistsTombstone(t *testing.T) {
+	startTestDB(t, config.Config{})
+	Set("a", 1)
+	swapMemory(database.MemoryTree)
+	waitForImmutables(0)
+
+	// a 只存在于 SSTable 中，删除标记也必须写入 WAL
+	DeleteAndGet[int]("a")
+	if _, ok, _ := Get[int]("a"); ok {
+		t.Fatal("a is still visible after delete")
+	}
+	reopenTestDB(t)
+	if _, ok, _ := Get[int]("a"); ok {
+		t.Fatal("a came back after restart")
+	}
+}
+
+// 内存表写满时切换 WAL 段，持久化后旧的段被删除
+func TestRotateAtMemtableSize(t *testing.T) {
+	dir := t.TempDir()
+	startTestDB(t, config.Config{DataDir: dir, MemtableSize: 4 << 10})
+	for i := 0; i < 500; i++ {
+		Set(fmt.Sprintf("key-%04d", i), i)
+	}
+	waitForImmutables(0)
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	if len(tables) == 0 {
+		t.Fatal("no memtable was flushed")
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 1 || filepath.Base(segments[0]) == "000001.log" {
+		t.Fatalf("segments = %v, want only the current rotated segment", segments)
+	}
+
+	reopenTestDB(t)
+	for i := 0; i < 500; i++ {
+		if v, ok, _ := Get[int](fmt.Sprintf("key-%04d", i)); !ok || v != i {
+			t.Fatalf("key-%04d = %d, %v", i, v, ok)
+		}
+	}
+}
+
+// SSTable 中的数据损坏时，Get 和 Scan 返回错误，而不是当作 key 不存在
+func TestGetCorruption(t *testing.T) {
+	// 不压缩，否则启动时的压缩会读取损坏的数据
+	con := config.Config{DataDir: t.TempDir(), PartSize: 10}
+	startTestDB(t, con)
+	Set("a", 1)
+	swapMemory(database.MemoryTree)
+	waitForImmutables(0)
+
+	tables, _ := filepath.Glob(filepath.Join(con.DataDir, "*.db"))
+	if len(tables) != 1 {
+		t.Fatalf("tables = %v", tables)
+	}
+	closeTestDB()
+	data, err := os.ReadFile(tables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[1] ^= 0xff
+	if err := os.WriteFile(tables[0], data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	startTestDB(t, con)
+
+	if _, ok, err := Get[int]("a"); ok || !errors.Is(err, sstable.ErrCorruption) {
+		t.Fatalf("Get(a) = %v, %v, want %v", ok, err, sstable.ErrCorruption)
+	}
+	if err := Scan("", func(string, int) bool { return true }); !errors.Is(err, sstable.ErrCorruption) {
+		t.Fatalf("Scan() = %v, want %v", err, sstable.ErrCorruption)
+	}
+}
@@ -1,7 +1,10 @@
 package kv
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 )
 
 type Status int8
@@ -30,7 +33,7 @@ func (kv *KV) Copy() *KV {
 	return &KV{
 		Key:    kv.Key,
 		Value:  kv.Value,
-		Status: StatusDeleted,
+		Status: kv.Status,
 	}
 }
 
@@ -44,12 +47,105 @@ func Marshal[T any](value T) ([]byte, error) {
 	return json.Marshal(value)
 }
 
+// 记录的编码格式
+const (
+	// FormatJSON 旧版本的编码，整条记录序列化为 JSON
+	FormatJSON = 0
+	// FormatBinary 紧凑的二进制编码：类型(1字节) + key长度(varint) + key + value长度(varint) + value
+	FormatBinary = 1
+)
+
+var ErrInvalidRecord = errors.New("kv: invalid record")
+
+// Decode 解码二进制编码的记录
 func Decode(data []byte) (KV, error) {
+	value, n, err := DecodeFrom(data)
+	if err != nil {
+		return value, err
+	}
+	if n != len(data) {
+		return value, ErrInvalidRecord
+	}
+	return value, nil
+}
+
+// DecodeFrom 从 data 的开头解码一条二进制编码的记录，返回记录和它占用的字节数
+// 返回的 Value 引用 data 中的内存，状态只能是 StatusDeleted 或 StatusSuccess
+func DecodeFrom(data []byte) (KV, int, error) {
 	var value KV
-	err := json.Unmarshal(data, &value)
-	return value, err
+	if len(data) < 1 {
+		return value, 0, ErrInvalidRecord
+	}
+	value.Status = Status(data[0])
+	if value.Status != StatusDeleted && value.Status != StatusSuccess {
+		return value, 0, fmt.Errorf("%w: unknown status %d", ErrInvalidRecord, data[0])
+	}
+	rest := data[1:]
+
+	key, rest, err := readBytes(rest)
+	if err != nil {
+		return value, 0, err
+	}
+	val, rest, err := readBytes(rest)
+	if err != nil {
+		return value, 0, err
+	}
+	value.Key = string(key)
+	if value.Status != StatusDeleted {
+		value.Value = val
+	}
+	return value, len(data) - len(rest), nil
 }
 
+// DecodeFormat 按照指定的格式解码记录，用于读取旧版本的文件
+func DecodeFormat(data []byte, format int) (KV, error) {
+	switch format {
+	case FormatJSON:
+		var value KV
+		err := json.Unmarshal(data, &value)
+		return value, err
+	case FormatBinary:
+		return Decode(data)
+	}
+	return KV{}, fmt.Errorf("kv: unknown record format %d", format)
+}
+
+// Encode 将记录编码为二进制
 func Encode(value KV) ([]byte, error) {
-	return json.Marshal(value)
+	return AppendEncode(make([]byte, 0, EncodedLen(value)), value), nil
+}
+
+// AppendEncode 将记录编码后追加到 dst 中
+func AppendEncode(dst []byte, value KV) []byte {
+	dst = append(dst, byte(value.Status))
+	dst = binary.AppendUvarint(dst, uint64(len(value.Key)))
+	dst = append(dst, value.Key...)
+	dst = binary.AppendUvarint(dst, uint64(len(value.Value)))
+	dst = append(dst, value.Value...)
+	return dst
+}
+
+// EncodedLen 记录编码后的长度
+func EncodedLen(value KV) int {
+	return 1 + uvarintLen(uint64(len(value.Key))) + len(value.Key) +
+		uvarintLen(uint64(len(value.Value))) + len(value.Value)
+}
+
+// 读取一个 varint 长度前缀的字节序列
+func readBytes(data []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return nil, nil, ErrInvalidRecord
+	}
+	end := size + int(n)
+	return data[size:end:end], data[end:], nil
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
 }
@@ -0,0 +1,69 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	values := []KV{
+		{Key: "a", Value: []byte(`1`), Status: StatusSuccess},
+		{Key: "", Value: []byte{}, Status: StatusSuccess},
+		{Key: strings.Repeat("k", 300), Value: bytes.Repeat([]byte("v"), 70000), Status: StatusSuccess},
+		{Key: "deleted", Status: StatusDeleted},
+	}
+	var data []byte
+	for _, value := range values {
+		before := len(data)
+		data = AppendEncode(data, value)
+		if len(data)-before != EncodedLen(value) {
+			t.Fatalf("%q: encoded %d bytes, EncodedLen = %d", value.Key, len(data)-before, EncodedLen(value))
+		}
+	}
+
+	// 多条记录连续编码，逐条解码
+	rest := data
+	for _, want := range values {
+		got, n, err := DecodeFrom(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Key != want.Key || got.Status != want.Status || !bytes.Equal(got.Value, want.Value) {
+			t.Fatalf("DecodeFrom() = %+v, want %+v", got, want)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		t.Fatalf("%d bytes left after decoding", len(rest))
+	}
+
+	// Decode 要求恰好是一条记录
+	one, _ := Encode(values[0])
+	if _, err := Decode(append(one, 0)); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatalf("Decode() with trailing data = %v", err)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	data, _ := Encode(KV{Key: "key", Value: []byte("value"), Status: StatusSuccess})
+	// 任何截断的输入都不能解码成功
+	for i := 0; i < len(data); i++ {
+		if _, _, err := DecodeFrom(data[:i]); !errors.Is(err, ErrInvalidRecord) {
+			t.Fatalf("DecodeFrom(%d bytes) = %v", i, err)
+		}
+	}
+	for _, status := range []byte{byte(StatusNone), 3, 0xff} {
+		bad := append([]byte{status}, data[1:]...)
+		if _, _, err := DecodeFrom(bad); !errors.Is(err, ErrInvalidRecord) {
+			t.Fatalf("DecodeFrom() with status %d = %v", status, err)
+		}
+	}
+	// 长度超出剩余数据
+	bad := append([]byte{}, data...)
+	bad[1] = 100
+	if _, _, err := DecodeFrom(bad); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatalf("DecodeFrom() with a long key = %v", err)
+	}
+}
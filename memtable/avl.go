@@ -0,0 +1,89 @@
+package memtable
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/lvtuwjl/tungdb/tung/avl"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+// AVLTree 使用 avl 包中的持久化平衡二叉树实现的内存表，顺序写入时不会退化
+// 每次写入生成一棵新树并原子地替换，读取和遍历只需要取得当前的树，不会阻塞写入，也不会被写入阻塞
+type AVLTree struct {
+	tree  atomic.Pointer[avl.Persistent[string, kv.KV]]
+	bytes atomic.Int64
+	// 写入之间互斥
+	mu sync.Mutex
+}
+
+func NewAVLTree() *AVLTree {
+	t := &AVLTree{}
+	t.tree.Store(&avl.Persistent[string, kv.KV]{})
+	return t
+}
+
+func (t *AVLTree) Size() int {
+	return t.tree.Load().Len()
+}
+
+// ApproximateBytes 内存表占用内存的近似值
+func (t *AVLTree) ApproximateBytes() int64 {
+	return t.bytes.Load()
+}
+
+// Get 查找key的值
+func (t *AVLTree) Get(key string) (kv.KV, kv.Status) {
+	value, ok := t.tree.Load().Get(key)
+	if !ok {
+		return kv.KV{}, kv.StatusNone
+	}
+	if value.Status == kv.StatusDeleted {
+		return kv.KV{}, kv.StatusDeleted
+	}
+	return value, kv.StatusSuccess
+}
+
+// Put 设置key的值 并返回旧值
+func (t *AVLTree) Put(key string, value []byte) (kv.KV, bool) {
+	return t.set(kv.KV{Key: key, Value: value, Status: kv.StatusSuccess})
+}
+
+// Delete 删除key，不存在时插入一个删除标记，返回删除前的值
+func (t *AVLTree) Delete(key string) (kv.KV, bool) {
+	return t.set(kv.KV{Key: key, Value: nil, Status: kv.StatusDeleted})
+}
+
+// Iterator 遍历内存表的快照，取得快照的开销是 O(1)
+func (t *AVLTree) Iterator() Iterator {
+	return &avlIterator{it: t.tree.Load().Iterator()}
+}
+
+func (t *AVLTree) set(value kv.KV) (kv.KV, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tree, old, replaced := t.tree.Load().Upsert(value.Key, value)
+	t.tree.Store(&tree)
+	if !replaced {
+		t.bytes.Add(entryBytes(value.Key, value.Value))
+		return kv.KV{}, false
+	}
+	t.bytes.Add(int64(len(value.Value) - len(old.Value)))
+	if old.Status == kv.StatusDeleted {
+		return kv.KV{}, false
+	}
+	return old, true
+}
+
+type avlIterator struct {
+	it *avl.Iterator[string, kv.KV]
+}
+
+func (it *avlIterator) Next() bool {
+	return it.it.Next()
+}
+
+func (it *avlIterator) KV() kv.KV {
+	return it.it.Value()
+}
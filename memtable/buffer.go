@@ -0,0 +1,72 @@
+package memtable
+
+import "sync"
+
+// WriteBufferManager 限制内存表占用的内存总量，可以在多个数据库之间共享
+// 数据库将创建的内存表注册到这里，内存表持久化后注销
+type WriteBufferManager struct {
+	capacity int64
+	tables   map[Memtable]struct{}
+	mu       sync.Mutex
+	cond     *sync.Cond
+}
+
+// NewWriteBufferManager 创建一个 WriteBufferManager，capacity 为内存总量的上限，单位字节
+func NewWriteBufferManager(capacity int64) *WriteBufferManager {
+	m := &WriteBufferManager{
+		capacity: capacity,
+		tables:   make(map[Memtable]struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Capacity 内存总量的上限
+func (m *WriteBufferManager) Capacity() int64 {
+	return m.capacity
+}
+
+// Register 开始统计一个内存表占用的内存
+func (m *WriteBufferManager) Register(t Memtable) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables[t] = struct{}{}
+}
+
+// Unregister 内存表持久化后不再统计，唤醒等待的写入
+func (m *WriteBufferManager) Unregister(t Memtable) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tables, t)
+	m.cond.Broadcast()
+}
+
+// Usage 所有内存表占用的内存总量
+func (m *WriteBufferManager) Usage() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage()
+}
+
+// Exceeded 内存总量是否超过了上限
+func (m *WriteBufferManager) Exceeded() bool {
+	return m.Usage() >= m.capacity
+}
+
+// Wait 内存总量超过上限时阻塞，直到有内存表被注销使内存总量低于上限，或者 stop 返回 true
+// stop 用于在没有正在持久化的内存表时避免永久等待
+func (m *WriteBufferManager) Wait(stop func() bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.usage() >= m.capacity && !stop() {
+		m.cond.Wait()
+	}
+}
+
+func (m *WriteBufferManager) usage() int64 {
+	total := int64(0)
+	for t := range m.tables {
+		total += t.ApproximateBytes()
+	}
+	return total
+}
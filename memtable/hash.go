@@ -0,0 +1,103 @@
+package memtable
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+// HashTable 哈希索引加排序数组实现的内存表
+// 点查和写入都是 O(1)，key 只在遍历时排序，适合以点查为主、很少遍历的场景
+type HashTable struct {
+	index map[string]*kv.KV
+	// 所有的 key，sorted 为 false 时新写入的 key 追加在末尾
+	keys   []string
+	sorted bool
+	bytes  int64
+	rw     sync.RWMutex
+}
+
+func NewHashTable() *HashTable {
+	return &HashTable{
+		index:  make(map[string]*kv.KV),
+		sorted: true,
+	}
+}
+
+func (h *HashTable) Size() int {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return len(h.keys)
+}
+
+// ApproximateBytes 内存表占用内存的近似值
+func (h *HashTable) ApproximateBytes() int64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.bytes
+}
+
+// Get 查找key的值
+func (h *HashTable) Get(key string) (kv.KV, kv.Status) {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+
+	value, ok := h.index[key]
+	if !ok {
+		return kv.KV{}, kv.StatusNone
+	}
+	if value.Status == kv.StatusDeleted {
+		return kv.KV{}, kv.StatusDeleted
+	}
+	return *value, kv.StatusSuccess
+}
+
+// Put 设置key的值 并返回旧值
+func (h *HashTable) Put(key string, value []byte) (kv.KV, bool) {
+	return h.set(kv.KV{Key: key, Value: value, Status: kv.StatusSuccess})
+}
+
+// Delete 删除key，不存在时插入一个删除标记，返回删除前的值
+func (h *HashTable) Delete(key string) (kv.KV, bool) {
+	return h.set(kv.KV{Key: key, Value: nil, Status: kv.StatusDeleted})
+}
+
+// Iterator 遍历内存表的快照，需要时先对 key 排序
+func (h *HashTable) Iterator() Iterator {
+	h.rw.Lock()
+	defer h.rw.Unlock()
+
+	if !h.sorted {
+		sort.Strings(h.keys)
+		h.sorted = true
+	}
+	values := make([]kv.KV, len(h.keys))
+	for i, key := range h.keys {
+		values[i] = *h.index[key]
+	}
+	return &sliceIterator{values: values}
+}
+
+func (h *HashTable) set(value kv.KV) (kv.KV, bool) {
+	h.rw.Lock()
+	defer h.rw.Unlock()
+
+	if old, ok := h.index[value.Key]; ok {
+		oldKV := *old
+		h.bytes += int64(len(value.Value) - len(old.Value))
+		*old = value
+		if oldKV.Status == kv.StatusDeleted {
+			return kv.KV{}, false
+		}
+		return oldKV, true
+	}
+
+	h.index[value.Key] = &value
+	if h.sorted && len(h.keys) > 0 && h.keys[len(h.keys)-1] > value.Key {
+		h.sorted = false
+	}
+	h.keys = append(h.keys, value.Key)
+	h.bytes += entryBytes(value.Key, value.Value)
+	return kv.KV{}, false
+}
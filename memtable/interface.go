@@ -0,0 +1,72 @@
+package memtable
+
+import "github.com/lvtuwjl/tungdb/tung/kv"
+
+// Memtable 内存表，所有实现都使用删除标记表示删除，删除标记会随内存表一起持久化
+type Memtable interface {
+	// Put 设置key的值 并返回未删除的旧值
+	Put(key string, value []byte) (kv.KV, bool)
+	// Delete 删除key，不存在时插入删除标记，返回未删除的旧值
+	Delete(key string) (kv.KV, bool)
+	// Get 查找key的值，已删除时返回 kv.StatusDeleted
+	Get(key string) (kv.KV, kv.Status)
+	// Iterator 按 key 升序遍历，包括删除标记
+	Iterator() Iterator
+	// ApproximateBytes 内存表占用内存的近似值
+	ApproximateBytes() int64
+	// Size 元素数量
+	Size() int
+}
+
+// 内存表的实现，通过 config.Config.MemtableType 选择
+const (
+	// TypeBST 二叉搜索树，默认的实现
+	TypeBST = "bst"
+	// TypeAVL 持久化平衡二叉树，遍历和快照不阻塞写入
+	TypeAVL = "avl"
+	// TypeSkipList 支持并发写入、无锁读取的跳表
+	TypeSkipList = "skiplist"
+	// TypeHash 哈希索引加排序数组，适合以点查为主的场景
+	TypeHash = "hash"
+)
+
+// 每个元素除 key 和 value 之外的内存开销的估计值
+const entryOverhead = 64
+
+// New 创建指定类型的内存表，类型为空时使用默认的实现
+func New(kind string) Memtable {
+	switch kind {
+	case "", TypeBST:
+		return NewTree()
+	case TypeAVL:
+		return NewAVLTree()
+	case TypeSkipList:
+		return NewSkipList()
+	case TypeHash:
+		return NewHashTable()
+	}
+	panic("memtable: unknown memtable type " + kind)
+}
+
+// Values 按 key 升序返回内存表中的所有元素
+func Values(m Memtable) []kv.KV {
+	values := make([]kv.KV, 0, m.Size())
+	it := m.Iterator()
+	for it.Next() {
+		values = append(values, it.KV())
+	}
+	return values
+}
+
+// 一个元素占用内存的估计值
+func entryBytes(key string, value []byte) int64 {
+	return int64(len(key) + len(value) + entryOverhead)
+}
+
+// Full 内存表是否已满，maxBytes 大于 0 时按占用的内存判断，否则按元素数量判断
+func Full(m Memtable, maxCount int, maxBytes int64) bool {
+	if maxBytes > 0 {
+		return m.ApproximateBytes() >= maxBytes
+	}
+	return m.Size() >= maxCount
+}
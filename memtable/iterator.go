@@ -0,0 +1,34 @@
+package memtable
+
+import "github.com/lvtuwjl/tungdb/tung/kv"
+
+// Iterator 按 key 升序遍历内存表，包括已删除的元素
+//
+//	it := list.Iterator()
+//	for it.Next() {
+//		value := it.KV()
+//	}
+type Iterator interface {
+	// Next 移动到下一个元素，没有更多元素时返回 false
+	Next() bool
+	// KV 返回当前元素
+	KV() kv.KV
+}
+
+// 遍历一个有序数组，用于需要在锁内生成快照的实现
+type sliceIterator struct {
+	values []kv.KV
+	index  int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.index >= len(it.values) {
+		return false
+	}
+	it.index++
+	return true
+}
+
+func (it *sliceIterator) KV() kv.KV {
+	return it.values[it.index-1]
+}
@@ -30,9 +30,10 @@ type treeNode struct {
 }
 
 type Tree struct {
-	root *treeNode
-	size int
-	rw   sync.RWMutex
+	root  *treeNode
+	size  int
+	bytes int64
+	rw    sync.RWMutex
 }
 
 func NewTree() *Tree {
@@ -46,6 +47,8 @@ func NewTree() *Tree {
 func (t *Tree) Init() {}
 
 func (t *Tree) Size() int {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
 	return t.size
 }
 
@@ -98,6 +101,7 @@ func (t *Tree) Put(key string, value []byte) (kv.KV, bool) {
 	if node == nil {
 		t.root = newNode
 		t.size++
+		t.bytes += entryBytes(key, value)
 		return kv.KV{}, false
 	}
 
@@ -105,6 +109,7 @@ func (t *Tree) Put(key string, value []byte) (kv.KV, bool) {
 		// 存在则更新
 		if key == node.kv.GetKey() {
 			oldKV := node.kv.Copy()
+			t.bytes += int64(len(value) - len(node.kv.Value))
 			node.kv.Value = value
 			node.kv.Status = kv.StatusSuccess
 
@@ -120,6 +125,7 @@ func (t *Tree) Put(key string, value []byte) (kv.KV, bool) {
 			if node.left == nil {
 				node.left = newNode
 				t.size++
+				t.bytes += entryBytes(key, value)
 				return kv.KV{}, false
 			}
 
@@ -130,6 +136,7 @@ func (t *Tree) Put(key string, value []byte) (kv.KV, bool) {
 			if node.right == nil {
 				node.right = newNode
 				t.size++
+				t.bytes += entryBytes(key, value)
 				return kv.KV{}, false
 			}
 			node = node.right
@@ -155,6 +162,8 @@ func (t *Tree) Delete(key string) (kv.KV, bool) {
 	node := t.root
 	if node == nil {
 		t.root = newNode
+		t.size++
+		t.bytes += entryBytes(key, nil)
 		return kv.KV{}, false
 	}
 
@@ -163,9 +172,9 @@ func (t *Tree) Delete(key string) (kv.KV, bool) {
 			// 存在且未被删除
 			if node.kv.Status != kv.StatusDeleted {
 				oldKV := node.kv.Copy()
+				t.bytes -= int64(len(node.kv.Value))
 				node.kv.Value = nil
 				node.kv.Status = kv.StatusDeleted
-				t.size--
 				return *oldKV, true
 			} else { // 已被删除过
 				return kv.KV{}, false
@@ -178,6 +187,7 @@ func (t *Tree) Delete(key string) (kv.KV, bool) {
 			if node.left == nil {
 				node.left = newNode
 				t.size++
+				t.bytes += entryBytes(key, nil)
 			}
 
 			// 继续对比下一层
@@ -186,6 +196,7 @@ func (t *Tree) Delete(key string) (kv.KV, bool) {
 			if node.right == nil {
 				node.right = newNode
 				t.size++
+				t.bytes += entryBytes(key, nil)
 			}
 			node = node.right
 		}
@@ -214,19 +225,34 @@ func (t *Tree) GetValues() []kv.KV {
 				break
 			}
 			values = append(values, popNode.kv)
-			node = node.right
+			node = popNode.right
 		}
 	}
 	return values
 }
 
+// Iterator 遍历内存表的快照
+func (t *Tree) Iterator() Iterator {
+	return &sliceIterator{values: t.GetValues()}
+}
+
+// ApproximateBytes 内存表占用内存的近似值
+func (t *Tree) ApproximateBytes() int64 {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return t.bytes
+}
+
 func (t *Tree) Swap() *Tree {
 	t.rw.Lock()
 	defer t.rw.Unlock()
 
 	newTree := NewTree()
 	newTree.root = t.root
+	newTree.size = t.size
+	newTree.bytes = t.bytes
 	t.root = nil
 	t.size = 0
+	t.bytes = 0
 	return newTree
 }
@@ -0,0 +1,100 @@
+package memtable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+func TestMemtableTombstone(t *testing.T) {
+	for _, kind := range []string{TypeBST, TypeAVL, TypeSkipList, TypeHash} {
+		t.Run(kind, func(t *testing.T) {
+			testTombstone(t, New(kind))
+		})
+	}
+}
+
+func testTombstone(t *testing.T, list Memtable) {
+	if _, ok := list.Put("a", []byte("1")); ok {
+		t.Fatal("Put of a new key returned an old value")
+	}
+	if old, ok := list.Put("a", []byte("2")); !ok || string(old.Value) != "1" {
+		t.Fatalf("Put() = %v, %v", old, ok)
+	}
+	if old, ok := list.Delete("a"); !ok || string(old.Value) != "2" {
+		t.Fatalf("Delete() = %v, %v", old, ok)
+	}
+	if _, status := list.Get("a"); status != kv.StatusDeleted {
+		t.Fatalf("Get() after Delete = %d", status)
+	}
+	// 不存在的 key 插入删除标记
+	if _, ok := list.Delete("b"); ok {
+		t.Fatal("Delete of a missing key returned an old value")
+	}
+	if _, status := list.Get("b"); status != kv.StatusDeleted {
+		t.Fatalf("Get() of a tombstone = %d", status)
+	}
+	if _, ok := list.Put("a", []byte("3")); ok {
+		t.Fatal("Put over a tombstone returned an old value")
+	}
+	if _, status := list.Get("c"); status != kv.StatusNone {
+		t.Fatalf("Get() of a missing key = %d", status)
+	}
+	// 删除标记也占用内存，计入数量
+	if size := list.Size(); size != 2 {
+		t.Fatalf("Size() = %d, want 2", size)
+	}
+}
+
+func TestMemtableIterator(t *testing.T) {
+	for _, kind := range []string{TypeBST, TypeAVL, TypeSkipList, TypeHash} {
+		t.Run(kind, func(t *testing.T) {
+			m := New(kind)
+			for _, key := range []string{"d", "b", "e", "a", "c"} {
+				m.Put(key, []byte(key))
+			}
+			m.Delete("c")
+			var keys []string
+			it := m.Iterator()
+			for it.Next() {
+				keys = append(keys, it.KV().Key)
+			}
+			if got := fmt.Sprint(keys); got != "[a b c d e]" {
+				t.Fatalf("keys = %s", got)
+			}
+			if m.ApproximateBytes() <= 0 {
+				t.Fatalf("ApproximateBytes() = %d", m.ApproximateBytes())
+			}
+		})
+	}
+}
+
+func TestWriteBufferManager(t *testing.T) {
+	m := NewWriteBufferManager(1024)
+	a, b := New(TypeBST), New(TypeSkipList)
+	m.Register(a)
+	m.Register(b)
+	a.Put("a", make([]byte, 600))
+	if m.Exceeded() {
+		t.Fatalf("Usage() = %d, should not exceed 1024", m.Usage())
+	}
+	b.Put("b", make([]byte, 600))
+	if !m.Exceeded() {
+		t.Fatalf("Usage() = %d, should exceed 1024", m.Usage())
+	}
+	if !Full(b, 0, 600) || Full(b, 0, 1024) {
+		t.Fatalf("Full() with ApproximateBytes() = %d", b.ApproximateBytes())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Wait(func() bool { return false })
+		close(done)
+	}()
+	m.Unregister(a)
+	<-done
+	if usage := m.Usage(); usage != b.ApproximateBytes() {
+		t.Fatalf("Usage() = %d, want %d", usage, b.ApproximateBytes())
+	}
+}
@@ -0,0 +1,204 @@
+package memtable
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+// 跳表的最大高度，每层的概率为 1/4，足够容纳数千万个元素
+const (
+	maxHeight   = 12
+	pBranchBits = 2
+)
+
+// 跳表节点，节点插入后不会被移除，删除只是将值替换为删除标记
+type skipNode struct {
+	key   string
+	value atomic.Pointer[kv.KV]
+	next  []atomic.Pointer[skipNode]
+}
+
+// SkipList 支持并发写入的跳表
+// 写入通过 CAS 链接节点，读取和遍历不需要加锁
+type SkipList struct {
+	head   *skipNode
+	height atomic.Int32
+	// 元素数量，包括删除标记
+	size  atomic.Int64
+	bytes atomic.Int64
+}
+
+func NewSkipList() *SkipList {
+	s := &SkipList{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], maxHeight)},
+	}
+	s.height.Store(1)
+	return s
+}
+
+// Size 元素数量，包括删除标记
+func (s *SkipList) Size() int {
+	return int(s.size.Load())
+}
+
+// ApproximateBytes 内存表占用内存的近似值
+func (s *SkipList) ApproximateBytes() int64 {
+	return s.bytes.Load()
+}
+
+// Get 查找key的值
+func (s *SkipList) Get(key string) (kv.KV, kv.Status) {
+	node := s.find(key)
+	if node == nil {
+		return kv.KV{}, kv.StatusNone
+	}
+	value := node.value.Load()
+	if value.Status == kv.StatusDeleted {
+		// 已删除
+		return kv.KV{}, kv.StatusDeleted
+	}
+	return *value, kv.StatusSuccess
+}
+
+// Put 设置key的值 并返回旧值
+func (s *SkipList) Put(key string, value []byte) (kv.KV, bool) {
+	return s.set(kv.KV{Key: key, Value: value, Status: kv.StatusSuccess})
+}
+
+// Delete 删除key，不存在时插入一个删除标记，返回删除前的值
+func (s *SkipList) Delete(key string) (kv.KV, bool) {
+	return s.set(kv.KV{Key: key, Value: nil, Status: kv.StatusDeleted})
+}
+
+// Iterator 返回一个迭代器，遍历期间并发的写入可能可见也可能不可见
+func (s *SkipList) Iterator() Iterator {
+	return &skipListIterator{node: s.head}
+}
+
+// 插入或替换一个元素，返回被替换的未删除的值
+func (s *SkipList) set(value kv.KV) (kv.KV, bool) {
+	var prev, next [maxHeight]*skipNode
+	searched, node := s.findSplice(value.Key, &prev, &next)
+	if node != nil {
+		return s.replace(node, value)
+	}
+
+	height := randomHeight()
+	node = &skipNode{
+		key:  value.Key,
+		next: make([]atomic.Pointer[skipNode], height),
+	}
+	node.value.Store(&value)
+
+	// 提升跳表的高度，查找时没有覆盖到的层从头节点开始，链接失败时会重新查找
+	listHeight := s.height.Load()
+	for int(listHeight) < height {
+		if s.height.CompareAndSwap(listHeight, int32(height)) {
+			break
+		}
+		listHeight = s.height.Load()
+	}
+	for level := searched; level < height; level++ {
+		prev[level] = s.head
+		next[level] = nil
+	}
+
+	// 从下往上逐层链接，第 0 层链接成功后节点即对其他读写可见
+	for level := 0; level < height; level++ {
+		for {
+			node.next[level].Store(next[level])
+			if prev[level].next[level].CompareAndSwap(next[level], node) {
+				break
+			}
+			// 有其他写入者修改了这一层，从前驱节点重新查找位置
+			var found *skipNode
+			prev[level], next[level], found = findSpliceForLevel(value.Key, level, prev[level])
+			if found != nil {
+				// 其他写入者插入了相同的 key，只可能发生在第 0 层
+				return s.replace(found, value)
+			}
+		}
+	}
+	s.size.Add(1)
+	s.bytes.Add(entryBytes(value.Key, value.Value) + int64(height-1)*8)
+	return kv.KV{}, false
+}
+
+// 替换节点的值
+func (s *SkipList) replace(node *skipNode, value kv.KV) (kv.KV, bool) {
+	old := node.value.Swap(&value)
+	s.bytes.Add(int64(len(value.Value) - len(old.Value)))
+	if old.Status == kv.StatusDeleted {
+		return kv.KV{}, false
+	}
+	return *old, true
+}
+
+// 查找 key 所在的节点
+func (s *SkipList) find(key string) *skipNode {
+	prev := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		var found *skipNode
+		prev, _, found = findSpliceForLevel(key, level, prev)
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// 查找每一层中 key 的前驱和后继节点，返回查找的层数，key 已经存在时同时返回它所在的节点
+func (s *SkipList) findSplice(key string, prev *[maxHeight]*skipNode, next *[maxHeight]*skipNode) (int, *skipNode) {
+	height := int(s.height.Load())
+	node := s.head
+	for level := height - 1; level >= 0; level-- {
+		var found *skipNode
+		node, next[level], found = findSpliceForLevel(key, level, node)
+		if found != nil {
+			return height, found
+		}
+		prev[level] = node
+	}
+	return height, nil
+}
+
+// 从 start 开始，在一层中查找 key 的前驱和后继节点
+func findSpliceForLevel(key string, level int, start *skipNode) (*skipNode, *skipNode, *skipNode) {
+	prev := start
+	for {
+		next := prev.next[level].Load()
+		if next == nil || next.key > key {
+			return prev, next, nil
+		}
+		if next.key == key {
+			return prev, next, next
+		}
+		prev = next
+	}
+}
+
+func randomHeight() int {
+	height := 1
+	for height < maxHeight && rand.Uint32()&(1<<pBranchBits-1) == 0 {
+		height++
+	}
+	return height
+}
+
+type skipListIterator struct {
+	node *skipNode
+}
+
+func (it *skipListIterator) Next() bool {
+	if it.node == nil {
+		return false
+	}
+	it.node = it.node.next[0].Load()
+	return it.node != nil
+}
+
+func (it *skipListIterator) KV() kv.KV {
+	return *it.node.value.Load()
+}
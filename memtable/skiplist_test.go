@@ -0,0 +1,106 @@
+package memtable
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+func TestSkipListConcurrentPut(t *testing.T) {
+	list := NewSkipList()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// 每个 key 会被两个协程写入
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%05d", (g%4)*1000+i)
+				list.Put(key, []byte(key))
+				if _, status := list.Get(key); status != kv.StatusSuccess {
+					t.Errorf("Get(%s) = %d", key, status)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if list.Size() != 4000 {
+		t.Fatalf("Size() = %d, want 4000", list.Size())
+	}
+	var keys []string
+	it := list.Iterator()
+	for it.Next() {
+		keys = append(keys, it.KV().Key)
+	}
+	if len(keys) != 4000 {
+		t.Fatalf("iterated %d keys, want 4000", len(keys))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatal("Iterator() is not sorted")
+	}
+}
+
+// 遍历时其它协程并发插入，遍历的结果仍然有序、没有重复，并且包含遍历开始前的所有 key
+func TestSkipListIterateDuringPut(t *testing.T) {
+	list := NewSkipList()
+	for i := 0; i < 1000; i += 2 {
+		key := fmt.Sprintf("%05d", i)
+		list.Put(key, []byte(key))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// 插入新的奇数 key，并覆盖已有的偶数 key
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("%05d", i*8+g*2+1)
+				list.Put(key, []byte(key))
+				key = fmt.Sprintf("%05d", (i*2)%1000)
+				list.Put(key, []byte(key))
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for round := 0; ; round++ {
+		var prev string
+		even := 0
+		it := list.Iterator()
+		for n := 0; it.Next(); n++ {
+			value := it.KV()
+			if n > 0 && value.Key <= prev {
+				t.Fatalf("round %d: %s after %s", round, value.Key, prev)
+			}
+			if string(value.Value) != value.Key {
+				t.Fatalf("round %d: %s = %s", round, value.Key, value.Value)
+			}
+			var i int
+			fmt.Sscanf(value.Key, "%d", &i)
+			if i < 1000 && i%2 == 0 {
+				even++
+			}
+			prev = value.Key
+		}
+		if even != 500 {
+			t.Fatalf("round %d: iterated %d of the 500 existing keys", round, even)
+		}
+		select {
+		case <-done:
+			if list.Size() != 500+8000 {
+				t.Fatalf("Size() = %d, want %d", list.Size(), 500+8000)
+			}
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package prefix 从 key 中提取前缀，SSTable 为提取出的前缀生成布隆过滤器，
+// 前缀查找时可以跳过不包含这个前缀的 SSTable
+package prefix
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Extractor 前缀提取器
+//
+// 对于 InDomain 的 key，以它为前缀的所有 key 都必须 InDomain，并且提取出相同的前缀，
+// 这样前缀查找时才能用查找的前缀代替 key 检查过滤器
+type Extractor interface {
+	// Name 名称，记录在 SSTable 中，名称不同时不使用前缀过滤器
+	Name() string
+	// InDomain key 是否有前缀
+	InDomain(key string) bool
+	// Transform 返回 key 的前缀，key 必须 InDomain
+	Transform(key string) string
+}
+
+// Fixed 使用 key 的前 n 个字节作为前缀，短于 n 的 key 没有前缀
+func Fixed(n int) Extractor {
+	return fixed(n)
+}
+
+type fixed int
+
+func (f fixed) Name() string {
+	return "fixed:" + strconv.Itoa(int(f))
+}
+
+func (f fixed) InDomain(key string) bool {
+	return len(key) >= int(f)
+}
+
+func (f fixed) Transform(key string) string {
+	return key[:f]
+}
+
+// Delimited 使用 key 中第一个 sep 及之前的部分作为前缀，例如 "tenant1:" 和 "tenant1:user"
+// 不包含 sep 的 key 没有前缀
+func Delimited(sep string) Extractor {
+	return delimited(sep)
+}
+
+type delimited string
+
+func (d delimited) Name() string {
+	return "delimited:" + string(d)
+}
+
+func (d delimited) InDomain(key string) bool {
+	return strings.Contains(key, string(d))
+}
+
+func (d delimited) Transform(key string) string {
+	return key[:strings.Index(key, string(d))+len(d)]
+}
@@ -0,0 +1,271 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+const (
+	// 默认的数据块大小
+	defaultBlockSize = 4 << 10
+	// 块尾部的长度：1 个字节的压缩算法和 4 个字节的 CRC32C
+	blockTrailerLen = 5
+	// 默认每 16 条记录设置一个重启点
+	defaultRestartInterval = 16
+)
+
+// ErrInvalidBlock 块或块的位置无法解码
+var ErrInvalidBlock = errors.New("sstable: invalid block")
+
+// 块在文件中的位置
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) encode() []byte {
+	buf := binary.AppendUvarint(nil, h.offset)
+	return binary.AppendUvarint(buf, h.size)
+}
+
+func decodeBlockHandle(data []byte) (blockHandle, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return blockHandle{}, ErrInvalidBlock
+	}
+	size, m := binary.Uvarint(data[n:])
+	if m <= 0 || n+m != len(data) {
+		return blockHandle{}, ErrInvalidBlock
+	}
+	return blockHandle{offset: offset, size: size}, nil
+}
+
+/*
+版本 5 起块中的 key 使用前缀压缩，每条记录只保存与上一个 key 不同的部分：
+┌────────┬──────────────┬────────────────┬────────────────┬────────────┬─────┐
+│ 状态 1B │ 共享长度 varint │ 非共享长度 varint │ 值的长度 varint │ 非共享的 key │ 值  │
+└────────┴──────────────┴────────────────┴────────────────┴────────────┴─────┘
+每隔 restartInterval 条记录设置一个重启点，重启点的记录保存完整的 key；
+块的最后是每个重启点的偏移（uint32）和重启点的数量（uint32），
+查找时先二分查找重启点，再从重启点开始按顺序读取。
+之前的版本中块依次存放 kv.AppendEncode 编码的记录
+*/
+
+// 生成一个块，索引块和元数据索引块也使用同样的格式，记录的值为编码后的 blockHandle
+type blockBuilder struct {
+	buf   []byte
+	count int
+	// 每隔多少条记录设置一个重启点，小于等于 0 时使用默认值
+	restartInterval int
+	restarts        []uint32
+	lastKey         string
+}
+
+func (b *blockBuilder) add(value kv.KV) {
+	interval := b.restartInterval
+	if interval <= 0 {
+		interval = defaultRestartInterval
+	}
+	shared := 0
+	if b.count%interval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		shared = sharedPrefixLen(b.lastKey, value.Key)
+	}
+	b.buf = append(b.buf, byte(value.Status))
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value.Key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value.Value)))
+	b.buf = append(b.buf, value.Key[shared:]...)
+	b.buf = append(b.buf, value.Value...)
+	b.lastKey = value.Key
+	b.count++
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.count == 0
+}
+
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// 在记录之后写入重启点，返回块的内容，在 reset 之前有效
+func (b *blockBuilder) finish() []byte {
+	for _, restart := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, restart)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.count = 0
+	b.restarts = b.restarts[:0]
+	b.lastKey = ""
+}
+
+// 两个 key 相同前缀的长度
+func sharedPrefixLen(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// 按顺序读取一个块中的记录
+type blockIterator struct {
+	// 块中的记录，不包括重启点
+	data   []byte
+	offset int
+	// key 是否使用前缀压缩，以及重启点的偏移
+	prefixed bool
+	restarts []byte
+	// 前缀压缩时当前记录完整的 key
+	key []byte
+	cur kv.KV
+	err error
+}
+
+// prefixed 为 true 时块为版本 5 起的前缀压缩格式
+func newBlockIterator(data []byte, prefixed bool) *blockIterator {
+	it := &blockIterator{data: data, prefixed: prefixed}
+	if !prefixed {
+		return it
+	}
+	if len(data) < 4 {
+		it.err = ErrInvalidBlock
+		return it
+	}
+	n := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if uint64(n) > uint64(len(data)-4)/4 {
+		it.err = ErrInvalidBlock
+		return it
+	}
+	end := len(data) - 4 - 4*int(n)
+	it.data = data[:end]
+	it.restarts = data[end : len(data)-4]
+	return it
+}
+
+// Next 移动到下一条记录，没有更多记录或者块损坏时返回 false
+func (it *blockIterator) Next() bool {
+	if it.err != nil || it.offset >= len(it.data) {
+		return false
+	}
+	if !it.prefixed {
+		value, n, err := kv.DecodeFrom(it.data[it.offset:])
+		if err != nil {
+			it.err = ErrInvalidBlock
+			return false
+		}
+		it.cur = value
+		it.offset += n
+		return true
+	}
+
+	status, shared, delta, value, n, err := decodeEntry(it.data[it.offset:])
+	if err != nil || shared > uint64(len(it.key)) {
+		it.err = ErrInvalidBlock
+		return false
+	}
+	it.key = append(it.key[:shared], delta...)
+	it.cur = kv.KV{Key: string(it.key), Status: status}
+	if status != kv.StatusDeleted {
+		it.cur.Value = value
+	}
+	it.offset += n
+	return true
+}
+
+// 移动到最后一个 key 小于 target 的重启点，之后的 Next 从这里开始按顺序读取，
+// 调用者需要跳过小于 target 的记录；旧格式的块没有重启点，仍然从头读取
+func (it *blockIterator) seek(target string) {
+	n := len(it.restarts) / 4
+	if it.err != nil || n == 0 {
+		return
+	}
+	// 第一个 key 大于等于 target 的重启点
+	i := sort.Search(n, func(i int) bool {
+		key, ok := it.restartKey(i)
+		if !ok {
+			it.err = ErrInvalidBlock
+			return true
+		}
+		return key >= target
+	})
+	if it.err == nil && i > 0 {
+		it.offset = it.restartOffset(i - 1)
+		it.key = it.key[:0]
+	}
+}
+
+func (it *blockIterator) restartOffset(i int) int {
+	return int(binary.LittleEndian.Uint32(it.restarts[4*i:]))
+}
+
+// 重启点的记录保存完整的 key
+func (it *blockIterator) restartKey(i int) (string, bool) {
+	offset := it.restartOffset(i)
+	if offset >= len(it.data) {
+		return "", false
+	}
+	_, shared, key, _, _, err := decodeEntry(it.data[offset:])
+	if err != nil || shared != 0 {
+		return "", false
+	}
+	return string(key), true
+}
+
+// 解码一条前缀压缩的记录，返回共享的长度、key 中不共享的部分、值和记录的长度
+func decodeEntry(data []byte) (kv.Status, uint64, []byte, []byte, int, error) {
+	if len(data) < 1 {
+		return 0, 0, nil, nil, 0, ErrInvalidBlock
+	}
+	status := kv.Status(data[0])
+	rest := data[1:]
+	var lens [3]uint64
+	for i := range lens {
+		x, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, 0, nil, nil, 0, ErrInvalidBlock
+		}
+		lens[i] = x
+		rest = rest[n:]
+	}
+	shared, unshared, valueLen := lens[0], lens[1], lens[2]
+	if unshared > uint64(len(rest)) || valueLen > uint64(len(rest))-unshared {
+		return 0, 0, nil, nil, 0, ErrInvalidBlock
+	}
+	end := int(unshared + valueLen)
+	n := len(data) - len(rest) + end
+	return status, shared, rest[:unshared], rest[unshared:end:end], n, nil
+}
+
+// KV 当前记录
+func (it *blockIterator) KV() kv.KV {
+	return it.cur
+}
+
+// Err 读取过程中遇到的错误
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+// 在 a 和 b 之间选择一个尽量短的分隔 key，满足 a <= key < b
+func shortSeparator(a string, b string) string {
+	n := sharedPrefixLen(a, b)
+	// a 是 b 的前缀时无法缩短
+	if n >= len(a) || n >= len(b) {
+		return a
+	}
+	if c := a[n]; c < 0xff && c+1 < b[n] {
+		return a[:n] + string([]byte{c + 1})
+	}
+	return a
+}
@@ -0,0 +1,32 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrCorruption SSTable 文件中的数据损坏，具体的文件和位置见 CorruptionError
+var ErrCorruption = errors.New("sstable: corruption")
+
+// CorruptionError 记录损坏的数据所在的文件和位置，errors.Is(err, ErrCorruption) 为 true
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("sstable: corruption in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+func (t *SSTable) corruption(offset int64, reason string) error {
+	return &CorruptionError{File: t.filePath, Offset: offset, Reason: reason}
+}
+
+// 块和尾部的校验和使用 CRC32C
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
@@ -6,14 +6,15 @@ import (
 	"time"
 
 	"github.com/lvtuwjl/tungdb/tung/config"
-	"github.com/lvtuwjl/tungdb/tung/kv"
-	"github.com/lvtuwjl/tungdb/tung/memtable"
 )
 
 /*
 TableTree 检查是否需要压缩 SSTable
 */
 
+// 压缩生成的 SSTable 文件默认的目标大小
+const defaultTargetFileSize = 64 << 20
+
 // Check 检查是否需要压缩数据库文件
 func (tree *TableTree) Check() {
 	tree.majorCompaction()
@@ -42,72 +43,67 @@ func (tree *TableTree) majorCompactionLevel(level int) {
 	}()
 
 	log.Printf("Compressing layer %d.db files\r\n", level)
-	// 用于加载 一个 SSTable 的数据区到缓存中
-	tableCache := make([]byte, levelMaxSize[level])
-	currentNode := tree.levels[level]
 
-	// 将当前层的 SSTable 合并到一个有序二叉树中
-	memoryTree := &memtable.Tree{}
-	//memoryTree.Init()
+	// SSTable 写入后不再修改，只有压缩会删除，读取时不需要持有锁
+	tree.mu.RLock()
+	var its []*tableIterator
+	for node := tree.levels[level]; node != nil; node = node.next {
+		// 压缩时读取的块不会再被读取，不放入缓存
+		its = append(its, node.table.iterator(ReadOptions{NoFillCache: true}))
+	}
+	tree.mu.RUnlock()
 
-	tree.mu.Lock()
-	for currentNode != nil {
-		table := currentNode.table
-		// 将 SSTable 的数据区加载到 tableCache 内存中
-		if int64(len(tableCache)) < table.tableMetaInfo.dataLen {
-			tableCache = make([]byte, table.tableMetaInfo.dataLen)
-		}
-		newSlice := tableCache[0:table.tableMetaInfo.dataLen]
-		// 读取 SSTable 的数据区
-		if _, err := table.file.Seek(0, 0); err != nil {
-			log.Println(" error open file ", table.filePath)
-			panic(err)
-		}
-		if _, err := table.file.Read(newSlice); err != nil {
-			log.Println(" error read file ", table.filePath)
-			panic(err)
-		}
-		// 读取每一个元素
-		for k, position := range table.sparseIndex {
-			if position.Deleted == false {
-				value, err := kv.Decode(newSlice[position.Start:(position.Start + position.Len)])
-				if err != nil {
-					log.Fatal(err)
-				}
-				memoryTree.Put(k, value.Value)
-			} else {
-				memoryTree.Delete(k)
-			}
+	// 将当前层的 SSTable 归并后流式写入下一层，后面的 SSTable 覆盖前面的，
+	// 输出的文件达到目标大小后切分；
+	// 目前最多支持 10 层，最后一层合并到本层，不切分，避免文件数量超过阈值后反复压缩
+	newLevel, target := level+1, targetFileSize()
+	if newLevel >= len(tree.levels) {
+		newLevel, target = level, 0
+	}
+	w := tree.newWriter(newLevel, target)
+	it := newMergeIterator(its)
+	for it.Next() {
+		if err := w.Add(it.KV()); err != nil {
+			// 删除已经生成的文件，压缩前的 SSTable 还在，重启后不会重复加载
+			_ = w.Abort()
+			log.Fatal("error write file,", err)
 		}
-		currentNode = currentNode.next
 	}
-	tree.mu.Unlock()
-
-	// 将 SortTree 压缩合并成一个 SSTable
-	values := memoryTree.GetValues()
-	newLevel := level + 1
-	// 目前最多支持 10 层
-	if newLevel > 10 {
-		newLevel = 10
+	if err := it.Err(); err != nil {
+		_ = w.Abort()
+		log.Println(" error read file,", err)
+		panic(err)
 	}
-	// 创建新的 SSTable
-	tree.createTable(values, newLevel)
-	// 清理该层的文件
-	oldNode := tree.levels[level]
-	// 重置该层
-	if level < 10 {
-		tree.levels[level] = nil
-		tree.clearLevel(oldNode)
+	paths, err := w.Finish()
+	if err != nil {
+		_ = w.Abort()
+		log.Fatal("error write file,", err)
 	}
+	tree.addTables(paths, newLevel)
+
+	// 清理该层压缩前的文件
+	tree.clearLevel(level, len(its))
+}
 
+// 压缩生成的单个 SSTable 文件的目标大小
+func targetFileSize() int64 {
+	if size := config.GetConfig().TargetFileSize; size > 0 {
+		return size
+	}
+	return defaultTargetFileSize
 }
 
-func (tree *TableTree) clearLevel(oldNode *tableNode) {
+// 删除该层最前面的 count 个 SSTable，压缩到本层时新的 SSTable 在它们之后
+func (tree *TableTree) clearLevel(level int, count int) {
 	tree.mu.Lock()
 	defer tree.mu.Unlock()
+	oldNode := tree.levels[level]
 	// 清理当前层的每个的 SSTable
-	for oldNode != nil {
-		err := oldNode.table.file.Close()
+	for ; count > 0 && oldNode != nil; count-- {
+		if tree.tables != nil {
+			tree.tables.remove(oldNode.table)
+		}
+		err := oldNode.table.close(true)
 		if err != nil {
 			log.Println(" error close file,", oldNode.table.filePath)
 			panic(err)
@@ -117,8 +113,8 @@ func (tree *TableTree) clearLevel(oldNode *tableNode) {
 			log.Println(" error delete file,", oldNode.table.filePath)
 			panic(err)
 		}
-		oldNode.table.file = nil
 		oldNode.table = nil
 		oldNode = oldNode.next
 	}
+	tree.levels[level] = oldNode
 }
@@ -0,0 +1,108 @@
+package sstable
+
+import (
+	"container/heap"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+// Iterator 按 key 升序遍历记录，包括删除标记
+type Iterator interface {
+	// Next 移动到下一条记录，没有更多记录时返回 false
+	Next() bool
+	// KV 当前记录
+	KV() kv.KV
+}
+
+// 合并多个 SSTable 的迭代器，按 key 升序输出，同一个 key 只输出最新的记录（包括删除标记）；
+// 每个迭代器只缓存当前的块，压缩时不需要把整层的数据读入内存
+type mergeIterator struct {
+	heap mergeHeap
+	// 第一次调用 Next 时才读取每个迭代器的第一条记录
+	started bool
+	its     []*tableIterator
+	cur     kv.KV
+	err     error
+}
+
+// its 从旧到新排列，相同的 key 以后面的为准
+func newMergeIterator(its []*tableIterator) *mergeIterator {
+	return &mergeIterator{its: its}
+}
+
+// Next 移动到下一个 key，没有更多记录或者读取失败时返回 false
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, it := range m.its {
+			m.push(it, i)
+		}
+	}
+	if m.err != nil || m.heap.Len() == 0 {
+		return false
+	}
+
+	// 堆顶是最小的 key 中最新的记录，其它迭代器中相同 key 的旧记录被跳过
+	top := heap.Pop(&m.heap).(mergeItem)
+	m.cur = top.cur
+	m.push(top.it, top.age)
+	for m.err == nil && m.heap.Len() > 0 && m.heap[0].cur.Key == m.cur.Key {
+		item := heap.Pop(&m.heap).(mergeItem)
+		m.push(item.it, item.age)
+	}
+	return m.err == nil
+}
+
+// 读取迭代器的下一条记录并放入堆中
+func (m *mergeIterator) push(it *tableIterator, age int) {
+	if it.Next() {
+		heap.Push(&m.heap, mergeItem{it: it, age: age, cur: it.KV()})
+		return
+	}
+	if err := it.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// KV 当前记录
+func (m *mergeIterator) KV() kv.KV {
+	return m.cur
+}
+
+// Err 读取过程中遇到的错误
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+type mergeItem struct {
+	it *tableIterator
+	// 越大越新
+	age int
+	cur kv.KV
+}
+
+// 按 key 升序，相同的 key 新的在前
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].cur.Key != h[j].cur.Key {
+		return h[i].cur.Key < h[j].cur.Key
+	}
+	return h[i].age > h[j].age
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
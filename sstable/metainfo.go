@@ -1,8 +1,15 @@
 package sstable
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
 /*
 
-索引是从数据区开始！
+旧格式（版本 0、1），索引是从数据区开始！
 0 ─────────────────────────────────────────────────────────►
 ◄───────────────────────────
           dataLen          ◄──────────────────
@@ -12,6 +19,18 @@ package sstable
 │          数据区           │   稀疏索引区     │    元数据     │
 │                          │                 │              │
 └──────────────────────────┴─────────────────┴──────────────┘
+
+块格式（版本 2 起）
+┌──────────┬─────┬──────────┬──────────────┬──────────┬──────────┐
+│ 数据块 0  │ ... │ 数据块 n  │  元数据索引块  │  索引块   │   尾部    │
+└──────────┴─────┴──────────┴──────────────┴──────────┴──────────┘
+数据块中的记录按 key 升序排列，索引块为每个数据块记录一个分隔 key 和它的位置，
+分隔 key 大于等于块中最大的 key，小于下一个块中最小的 key；
+元数据索引块按名称记录其它元数据块的位置，用于以后扩展文件格式；
+版本 3 中每个块后面有一个字节的块尾部，记录块的压缩算法，块的位置中的长度不包括块尾部；
+版本 4 的块尾部再增加块内容和压缩算法的 CRC32C，文件尾部之前增加文件尾部的 CRC32C；
+版本 5 中块内的 key 使用前缀压缩，块的最后记录重启点，见 block.go；
+尾部的长度固定，记录元数据索引块和索引块的位置、版本号和魔数
 */
 
 // MetaInfo 是SSTable的元数据
@@ -27,4 +46,122 @@ type MetaInfo struct {
 	indexStart int64
 	// 稀疏索引区长度
 	indexLen int64
+
+	// 块格式中元数据索引块的位置
+	metaindex blockHandle
+	// 块格式中索引块的位置
+	index blockHandle
+}
+
+// SSTable 文件格式版本，记录在元数据中
+const (
+	// 数据区中的记录为 JSON 编码
+	tableVersionJSON = 0
+	// 数据区中的记录为二进制编码
+	tableVersionBinary = 1
+	// 块格式，以 tableMagic 结尾
+	tableVersionBlock = 2
+	// 每个块后面有一个字节的尾部，记录块的压缩算法
+	tableVersionBlockTrailer = 3
+	// 块尾部和文件尾部增加 CRC32C 校验和
+	tableVersionChecksum = 4
+	// 块内的 key 使用前缀压缩，块的最后记录重启点
+	tableVersionPrefixKeys = 5
+
+	currentTableVersion = tableVersionPrefixKeys
+)
+
+const (
+	// 块格式文件的最后 8 个字节，旧格式的文件以索引区长度结尾，不会与它相同
+	tableMagic = uint64(0x74756e6773737462) // "tungsstb"
+	// 块格式尾部的长度：两个块位置、版本号和魔数
+	footerLen = 8 * 6
+	// 版本 4 起，尾部之前有 8 个字节：尾部的 CRC32C 和 4 个保留字节
+	footerChecksumLen = 8
+	// 旧格式元数据的长度
+	legacyMetaLen = 8 * 5
+)
+
+// 数据区中记录的编码格式
+func (m MetaInfo) recordFormat() int {
+	if m.version == tableVersionJSON {
+		return kv.FormatJSON
+	}
+	return kv.FormatBinary
+}
+
+// 是否为块格式
+func (m MetaInfo) blockBased() bool {
+	return m.version >= tableVersionBlock
+}
+
+// 块尾部的长度
+func (m MetaInfo) blockTrailerLen() int64 {
+	switch {
+	case m.version >= tableVersionChecksum:
+		return blockTrailerLen
+	case m.version >= tableVersionBlockTrailer:
+		// 只有压缩算法
+		return 1
+	}
+	return 0
+}
+
+// 块内的 key 是否使用前缀压缩
+func (m MetaInfo) prefixKeys() bool {
+	return m.version >= tableVersionPrefixKeys
+}
+
+// 块和尾部是否有校验和
+func (m MetaInfo) hasChecksum() bool {
+	return m.version >= tableVersionChecksum
+}
+
+// 编码块格式的尾部，包括之前的校验区
+func encodeFooter(m MetaInfo) []byte {
+	buf := make([]byte, footerChecksumLen+footerLen)
+	footer := encodeFooterBody(m, buf[footerChecksumLen:])
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(footer, crcTable))
+	return buf
+}
+
+func encodeFooterBody(m MetaInfo, buf []byte) []byte {
+	binary.LittleEndian.PutUint64(buf[0:], m.metaindex.offset)
+	binary.LittleEndian.PutUint64(buf[8:], m.metaindex.size)
+	binary.LittleEndian.PutUint64(buf[16:], m.index.offset)
+	binary.LittleEndian.PutUint64(buf[24:], m.index.size)
+	binary.LittleEndian.PutUint64(buf[32:], uint64(m.version))
+	binary.LittleEndian.PutUint64(buf[40:], tableMagic)
+	return buf
+}
+
+// 解码块格式的尾部，buf 的长度为 footerLen，且以 tableMagic 结尾
+func decodeFooter(buf []byte) MetaInfo {
+	m := MetaInfo{
+		metaindex: blockHandle{
+			offset: binary.LittleEndian.Uint64(buf[0:]),
+			size:   binary.LittleEndian.Uint64(buf[8:]),
+		},
+		index: blockHandle{
+			offset: binary.LittleEndian.Uint64(buf[16:]),
+			size:   binary.LittleEndian.Uint64(buf[24:]),
+		},
+		version: int64(binary.LittleEndian.Uint64(buf[32:])),
+	}
+	// 数据区为第一个元数据块之前的部分
+	m.dataLen = int64(m.metaindex.offset)
+	m.indexStart = int64(m.index.offset)
+	m.indexLen = int64(m.index.size)
+	return m
+}
+
+// 解码旧格式的元数据，buf 的长度为 legacyMetaLen
+func decodeLegacyMeta(buf []byte) MetaInfo {
+	return MetaInfo{
+		version:    int64(binary.LittleEndian.Uint64(buf[0:])),
+		dataStart:  int64(binary.LittleEndian.Uint64(buf[8:])),
+		dataLen:    int64(binary.LittleEndian.Uint64(buf[16:])),
+		indexStart: int64(binary.LittleEndian.Uint64(buf[24:])),
+		indexLen:   int64(binary.LittleEndian.Uint64(buf[32:])),
+	}
 }
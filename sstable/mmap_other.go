@@ -0,0 +1,17 @@
+//go:build !unix
+
+package sstable
+
+import (
+	"errors"
+	"os"
+)
+
+// 不支持 mmap 的平台上总是使用 ReadAt 读取
+func mmapFile(*os.File) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap([]byte) error {
+	return nil
+}
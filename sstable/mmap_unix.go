@@ -0,0 +1,26 @@
+//go:build unix
+
+package sstable
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// 将整个文件只读映射到内存
+func mmapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 || int64(int(size)) != size {
+		return nil, errors.New("file size cannot be mapped")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
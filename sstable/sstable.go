@@ -1,25 +1,63 @@
 package sstable
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/lvtuwjl/tungdb/tung/bloom"
+	"github.com/lvtuwjl/tungdb/tung/cache"
+	"github.com/lvtuwjl/tungdb/tung/compress"
 	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/prefix"
 )
 
 type SSTable struct {
-	// 文件句柄，要注意，操作系统的文件句柄是有限的
+	// 文件句柄，要注意，操作系统的文件句柄是有限的；
+	// 第一次读取时才打开，可能被 tableCache 关闭，之后的读取会重新打开
 	file     *os.File
 	filePath string
-	// 元数据
-	tableMetaInfo MetaInfo
-	// 文件的稀疏索引列表
+	// 开启 mmap 时文件的只读映射，为空时使用 ReadAt 读取
+	data []byte
+	// 打开文件时是否映射到内存
+	mmap bool
+	// 从文件中加载的元数据，为空时在下次读取前加载
+	meta atomic.Pointer[tableMeta]
+	// 保证同时只有一个协程加载元数据
+	loadMu sync.Mutex
+	// 读取使用 ReadAt 或者 mmap，不改变文件偏移，持有读锁即可并发读取；
+	// 打开和关闭文件时持有写锁
+	mu sync.RWMutex
+	// 数据块缓存，为空时不缓存，id 为缓存中区分文件的编号
+	cache *cache.Cache
+	id    uint64
+	// 限制打开的文件数量，为空时不限制
+	tables *tableCache
+}
+
+// SSTable 加载到内存中的元数据，文件写入后不再修改，释放后重新加载得到的内容相同
+type tableMeta struct {
+	info MetaInfo
+	// 旧格式的稀疏索引列表，每个 key 一项
 	sparseIndex map[string]Position
-	// 排序后的key列表
+	// 旧格式中排序后的key列表
 	sortIndex []string
-	// SSTable 只能使用排他锁
-	mu sync.Mutex
+	// 块格式的索引，每个数据块一项，按分隔 key 升序排列
+	index []indexEntry
+	// 块格式中元数据块的位置，按名称查找
+	metaindex map[string]blockHandle
+	// 所有 key 的布隆过滤器，旧格式或者生成时没有开启时为空
+	filter bloom.Filter
+	// key 前缀的布隆过滤器，生成时使用的前缀提取器与当前配置的相同时才加载
+	prefixFilter bloom.Filter
+	extractor    prefix.Extractor
 
 	/*
 		sortIndex是有序的，便于CPU缓存等，还可以使用布隆过滤器bloom，有助于快速查找。
@@ -27,65 +65,402 @@ type SSTable struct {
 	*/
 }
 
+// 索引块中的一项
+type indexEntry struct {
+	// 大于等于块中最大的 key，小于下一个块中最小的 key
+	separator string
+	handle    blockHandle
+}
+
+// Init 打开 SSTable 并加载元数据
 func (t *SSTable) Init(path string) {
 	t.filePath = path
-	t.mu = sync.Mutex{}
-	t.loadFileHandle()
+	t.id = cache.NewFileID()
+	if _, err := t.metadata(); err != nil {
+		log.Println(" error open file ", path)
+		panic(err)
+	}
+}
+
+// ReadOptions 读取选项，零值为默认选项
+type ReadOptions struct {
+	// 不检查数据块的校验和，索引等元数据在加载时总是检查；读取的数据块不放入缓存
+	SkipChecksums bool
+	// 读取的数据块不放入缓存，用于不会被再次读取的大范围读取
+	NoFillCache bool
 }
 
+// Search 查找 key，读取失败时记录日志并返回 kv.StatusNone
 func (t *SSTable) Search(key string) (kv.KV, kv.Status) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	value, status, err := t.SearchWithOptions(key, ReadOptions{})
+	if err != nil {
+		log.Println(err)
+	}
+	return value, status
+}
+
+// SearchWithOptions 查找 key，数据损坏时返回 ErrCorruption
+func (t *SSTable) SearchWithOptions(key string, opts ReadOptions) (kv.KV, kv.Status, error) {
+	m, err := t.metadata()
+	if err != nil {
+		return kv.KV{}, kv.StatusNone, err
+	}
+	if !m.info.blockBased() {
+		return t.searchLegacy(m, key)
+	}
 
+	// 二分查找第一个分隔 key 不小于 key 的块，key 只可能在这个块中
+	i := sort.Search(len(m.index), func(i int) bool {
+		return m.index[i].separator >= key
+	})
+	if i == len(m.index) {
+		return kv.KV{}, kv.StatusNone, nil
+	}
+	handle := m.index[i].handle
+	data, err := t.readBlock(m, handle, opts)
+	if err != nil {
+		return kv.KV{}, kv.StatusNone, err
+	}
+	it := newBlockIterator(data, m.info.prefixKeys())
+	it.seek(key)
+	for it.Next() {
+		value := it.KV()
+		if value.Key < key {
+			continue
+		}
+		if value.Key > key {
+			break
+		}
+		if value.Status == kv.StatusDeleted {
+			return kv.KV{}, kv.StatusDeleted, nil
+		}
+		return value, kv.StatusSuccess, nil
+	}
+	if err := it.Err(); err != nil {
+		return kv.KV{}, kv.StatusNone, t.corruption(int64(handle.offset), err.Error())
+	}
+	return kv.KV{}, kv.StatusNone, nil
+}
+
+// 按 key 升序遍历以 prefix 开头的记录，包括删除标记
+func (t *SSTable) scanPrefix(prefix string, fn func(kv.KV)) error {
+	m, err := t.metadata()
+	if err != nil {
+		return err
+	}
+	if !m.info.blockBased() {
+		for i := sort.SearchStrings(m.sortIndex, prefix); i < len(m.sortIndex); i++ {
+			key := m.sortIndex[i]
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			position := m.sparseIndex[key]
+			if position.Deleted {
+				fn(kv.KV{Key: key, Status: kv.StatusDeleted})
+				continue
+			}
+			value, err := t.readRecord(m, position)
+			if err != nil {
+				return err
+			}
+			fn(value)
+		}
+		return nil
+	}
+
+	// 从第一个可能包含 prefix 的块开始读取
+	i := sort.Search(len(m.index), func(i int) bool {
+		return m.index[i].separator >= prefix
+	})
+	for ; i < len(m.index); i++ {
+		handle := m.index[i].handle
+		data, err := t.readBlock(m, handle, ReadOptions{})
+		if err != nil {
+			return err
+		}
+		it := newBlockIterator(data, m.info.prefixKeys())
+		it.seek(prefix)
+		for it.Next() {
+			value := it.KV()
+			if value.Key < prefix {
+				continue
+			}
+			if !strings.HasPrefix(value.Key, prefix) {
+				return nil
+			}
+			fn(value)
+		}
+		if err := it.Err(); err != nil {
+			return t.corruption(int64(handle.offset), err.Error())
+		}
+	}
+	return nil
+}
+
+// 在旧格式的 SSTable 中查找
+func (t *SSTable) searchLegacy(m *tableMeta, key string) (kv.KV, kv.Status, error) {
 	// 元素定位
 	var position = Position{
 		Start: -1,
 	}
 	l := 0
-	r := len(t.sortIndex) - 1
+	r := len(m.sortIndex) - 1
 
 	// 二分查找法，查找key是否存在
 	for l <= r {
 		mid := (l + r) >> 1
-		if t.sortIndex[mid] == key {
+		if m.sortIndex[mid] == key {
 			// 获取元素定位
-			position = t.sparseIndex[key]
+			position = m.sparseIndex[key]
 			// 如果元素已被删除，则返回
 			if position.Deleted {
-				return kv.KV{}, kv.StatusDeleted
+				return kv.KV{}, kv.StatusDeleted, nil
 			}
 			break
-		} else if t.sortIndex[mid] < key {
+		} else if m.sortIndex[mid] < key {
 			l = mid + 1
-		} else if t.sortIndex[mid] > key {
+		} else if m.sortIndex[mid] > key {
 			r = mid - 1
 		}
 	}
 
 	if position.Start == -1 {
-		return kv.KV{}, kv.StatusNone
+		return kv.KV{}, kv.StatusNone, nil
 	}
 
-	// Todo:如果读取失败，需要增加错误处理过程
 	// 从磁盘文件中查找
-	bytes := make([]byte, position.Len)
-	if _, err := t.file.Seek(position.Start, 0); err != nil {
-		log.Println(err)
-		return kv.KV{}, kv.StatusNone
+	value, err := t.readRecord(m, position)
+	if err != nil {
+		return kv.KV{}, kv.StatusNone, err
 	}
+	return value, kv.StatusSuccess, nil
+}
 
-	if _, err := t.file.Read(bytes); err != nil {
-		log.Println(err)
-		return kv.KV{}, kv.StatusNone
+// 读取旧格式中的一条记录
+func (t *SSTable) readRecord(m *tableMeta, position Position) (kv.KV, error) {
+	bytes, err := t.read(position.Start, position.Len)
+	if err != nil {
+		return kv.KV{}, err
+	}
+	// 旧格式没有校验和，只能在解码失败时发现损坏
+	value, err := kv.DecodeFormat(bytes, m.info.recordFormat())
+	if err != nil {
+		return kv.KV{}, t.corruption(position.Start, err.Error())
+	}
+	return value, nil
+}
+
+// 读取一个块，先查缓存；从文件读取时检查校验和，再按块尾部记录的压缩算法解压
+// 缓存中只有检查过校验和的块，没有检查的块不放入缓存
+func (t *SSTable) readBlock(m *tableMeta, handle blockHandle, opts ReadOptions) ([]byte, error) {
+	key := cache.Key{FileID: t.id, Offset: handle.offset}
+	if t.cache != nil {
+		if data, ok := t.cache.Get(key); ok {
+			return data, nil
+		}
+	}
+	data, err := t.loadBlock(m.info, handle, !opts.SkipChecksums)
+	if err == nil && t.cache != nil && !opts.NoFillCache && !opts.SkipChecksums {
+		t.cache.Set(key, data)
+	}
+	return data, err
+}
+
+// 从文件中读取一个块，verify 为 true 时检查校验和
+func (t *SSTable) loadBlock(meta MetaInfo, handle blockHandle, verify bool) ([]byte, error) {
+	trailer := meta.blockTrailerLen()
+	data, err := t.read(int64(handle.offset), int64(handle.size)+trailer)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, t.corruption(int64(handle.offset), "block is out of range")
+	}
+	if err != nil || trailer == 0 {
+		return data, err
 	}
 
-	value, err := kv.Decode(bytes)
+	n := handle.size
+	if verify && meta.hasChecksum() {
+		want := binary.LittleEndian.Uint32(data[n+1:])
+		if crc32.Checksum(data[:n+1], crcTable) != want {
+			return nil, t.corruption(int64(handle.offset), "block checksum mismatch")
+		}
+	}
+	kind := compress.Type(data[n])
+	data = data[:n]
+	if kind == compress.None {
+		return data, nil
+	}
+	c, err := compress.Get(kind)
 	if err != nil {
-		log.Println(err)
-		return kv.KV{}, kv.StatusNone
+		return nil, t.corruption(int64(handle.offset), err.Error())
+	}
+	data, err = c.Decompress(nil, data)
+	if err != nil {
+		return nil, t.corruption(int64(handle.offset), err.Error())
+	}
+	return data, nil
+}
+
+// 从文件的 offset 处读取 n 个字节
+func (t *SSTable) read(offset int64, n int64) ([]byte, error) {
+	bytes, err := t.readFile(offset, n)
+	// 读取结束、释放锁之后再记录，关闭其它文件时不会持有这个文件的锁
+	if t.tables != nil && err == nil {
+		t.tables.touch(t)
+	}
+	return bytes, err
+}
+
+func (t *SSTable) readFile(offset int64, n int64) ([]byte, error) {
+	t.mu.RLock()
+	// 文件没有打开，或者在打开之后又被关闭
+	for t.file == nil {
+		t.mu.RUnlock()
+		if err := t.open(); err != nil {
+			return nil, err
+		}
+		t.mu.RLock()
 	}
+	defer t.mu.RUnlock()
+
+	bytes := make([]byte, n)
+	if t.data != nil {
+		// 返回复制的数据，关闭文件解除映射后仍然可以使用
+		if offset < 0 || offset+n > int64(len(t.data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		copy(bytes, t.data[offset:])
+		return bytes, nil
+	}
+	if _, err := t.file.ReadAt(bytes, offset); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// 以只读的形式打开文件，开启 mmap 时同时映射到内存，映射失败时改用 ReadAt
+func (t *SSTable) open() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(t.filePath, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if t.mmap {
+		data, err := mmapFile(f)
+		if err != nil {
+			log.Println(" error mmap file ", t.filePath, err)
+		} else {
+			t.data = data
+		}
+	}
+	t.file = f
+	return nil
+}
+
+// 关闭文件句柄，之后的读取会重新打开文件；dropMeta 为 true 时同时释放元数据
+func (t *SSTable) close(dropMeta bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if dropMeta {
+		t.meta.Store(nil)
+	}
+	if t.file == nil {
+		return nil
+	}
+	var err error
+	if t.data != nil {
+		err = munmap(t.data)
+		t.data = nil
+	}
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	t.file = nil
+	return err
+}
+
+// 按 key 升序遍历 SSTable 中的所有记录，包括删除标记
+type tableIterator struct {
+	table *SSTable
+	// 遍历开始时的元数据，遍历过程中不受元数据释放的影响
+	meta *tableMeta
+	opts ReadOptions
+	// 块格式中下一个要读取的块
+	block int
+	it    *blockIterator
+	// 旧格式中下一个要读取的 key
+	pos int
+	cur kv.KV
+	err error
+}
+
+func (t *SSTable) iterator(opts ReadOptions) *tableIterator {
+	return &tableIterator{table: t, opts: opts}
+}
+
+// Next 移动到下一条记录，没有更多记录或者读取失败时返回 false
+func (it *tableIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	t := it.table
+	if it.meta == nil {
+		if it.meta, it.err = t.metadata(); it.err != nil {
+			return false
+		}
+	}
+	m := it.meta
+	if !m.info.blockBased() {
+		if it.pos >= len(m.sortIndex) {
+			return false
+		}
+		key := m.sortIndex[it.pos]
+		it.pos++
+		position := m.sparseIndex[key]
+		if position.Deleted {
+			it.cur = kv.KV{Key: key, Status: kv.StatusDeleted}
+			return true
+		}
+		it.cur, it.err = t.readRecord(m, position)
+		return it.err == nil
+	}
+
+	for {
+		if it.it != nil && it.it.Next() {
+			it.cur = it.it.KV()
+			return true
+		}
+		if it.it != nil && it.it.Err() != nil {
+			handle := m.index[it.block-1].handle
+			it.err = t.corruption(int64(handle.offset), it.it.Err().Error())
+			return false
+		}
+		if it.block >= len(m.index) {
+			return false
+		}
+		data, err := t.readBlock(m, m.index[it.block].handle, it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.block++
+		it.it = newBlockIterator(data, m.info.prefixKeys())
+	}
+}
+
+// KV 当前记录
+func (it *tableIterator) KV() kv.KV {
+	return it.cur
+}
 
-	return value, kv.StatusSuccess
+// Err 读取过程中遇到的错误
+func (it *tableIterator) Err() error {
+	return it.err
 }
 
 /*
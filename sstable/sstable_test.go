@@ -0,0 +1,701 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lvtuwjl/tungdb/tung/cache"
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/prefix"
+)
+
+// 写入一个块格式的 SSTable 并打开它
+func writeTestTable(t *testing.T, values []kv.KV, blockSize int) *SSTable {
+	t.Helper()
+	opts := defaultWriterOptions(0)
+	opts.blockSize = blockSize
+	return writeTestTableOptions(t, values, opts)
+}
+
+func writeTestTableOptions(t *testing.T, values []kv.KV, opts writerOptions) *SSTable {
+	t.Helper()
+	filePath := path.Join(t.TempDir(), "0.0.db")
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newTableWriter(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range values {
+		if err := w.add(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	table := &SSTable{}
+	table.Init(filePath)
+	t.Cleanup(func() { _ = table.close(true) })
+	return table
+}
+
+func testValues(n int) []kv.KV {
+	values := make([]kv.KV, 0, n)
+	for i := 0; i < n; i++ {
+		value := kv.KV{Key: fmt.Sprintf("key%05d", i*2), Value: []byte(fmt.Sprint(i)), Status: kv.StatusSuccess}
+		if i%7 == 0 {
+			value.Value, value.Status = nil, kv.StatusDeleted
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func TestBlockTable(t *testing.T) {
+	values := testValues(1000)
+	table := writeTestTable(t, values, 256)
+	if len(table.meta.Load().index) < 10 {
+		t.Fatalf("%d blocks, want at least 10", len(table.meta.Load().index))
+	}
+
+	for i, value := range values {
+		got, status := table.Search(value.Key)
+		if value.Status == kv.StatusDeleted {
+			if status != kv.StatusDeleted {
+				t.Fatalf("Search(%s) = %d, want deleted", value.Key, status)
+			}
+			continue
+		}
+		if status != kv.StatusSuccess || string(got.Value) != string(value.Value) {
+			t.Fatalf("Search(%s) = %v, %d", value.Key, got, status)
+		}
+		// 两个 key 之间、所有 key 之后的 key 不存在
+		missing := fmt.Sprintf("key%05d", i*2+1)
+		if _, status := table.Search(missing); status != kv.StatusNone {
+			t.Fatalf("Search(%s) = %d, want none", missing, status)
+		}
+	}
+	if _, status := table.Search("a"); status != kv.StatusNone {
+		t.Fatalf("Search(a) = %d", status)
+	}
+
+	it := table.iterator(ReadOptions{})
+	n := 0
+	for ; it.Next(); n++ {
+		if got := it.KV(); got.Key != values[n].Key || got.Status != values[n].Status {
+			t.Fatalf("iterator[%d] = %v, want %v", n, got, values[n])
+		}
+	}
+	if it.Err() != nil || n != len(values) {
+		t.Fatalf("iterated %d records, err %v", n, it.Err())
+	}
+}
+
+// 旧格式的文件仍然可以读取
+func TestLegacyTable(t *testing.T) {
+	values := testValues(20)
+	var data []byte
+	positions := make(map[string]Position)
+	for _, value := range values {
+		record, _ := kv.Encode(value)
+		positions[value.Key] = Position{
+			Start:   int64(len(data)),
+			Len:     int64(len(record)),
+			Deleted: value.Status == kv.StatusDeleted,
+		}
+		data = append(data, record...)
+	}
+	index, _ := json.Marshal(positions)
+	meta := []int64{tableVersionBinary, 0, int64(len(data)), int64(len(data)), int64(len(index))}
+	buf := append(data, index...)
+	for _, v := range meta {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+	}
+	filePath := path.Join(t.TempDir(), "0.0.db")
+	if err := os.WriteFile(filePath, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	table := &SSTable{}
+	table.Init(filePath)
+	defer table.close(true)
+
+	if table.meta.Load().info.blockBased() {
+		t.Fatal("legacy table detected as block based")
+	}
+	if got, status := table.Search(values[1].Key); status != kv.StatusSuccess || string(got.Value) != "1" {
+		t.Fatalf("Search(%s) = %v, %d", values[1].Key, got, status)
+	}
+	if _, status := table.Search(values[0].Key); status != kv.StatusDeleted {
+		t.Fatalf("Search(%s) = %d, want deleted", values[0].Key, status)
+	}
+	n := 0
+	for it := table.iterator(ReadOptions{}); it.Next(); n++ {
+	}
+	if n != len(values) {
+		t.Fatalf("iterated %d records, want %d", n, len(values))
+	}
+}
+
+func TestShortSeparator(t *testing.T) {
+	for _, c := range []struct{ a, b, want string }{
+		{"abc", "abz", "abd"},
+		{"abc", "abd", "abc"},
+		{"ab", "abc", "ab"},
+		{"a1234", "b", "a1234"},
+		{"a1234", "c", "b"},
+	} {
+		got := shortSeparator(c.a, c.b)
+		if got != c.want || got < c.a || got >= c.b {
+			t.Errorf("shortSeparator(%q, %q) = %q, want %q", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	values := testValues(1000)
+	tree := &TableTree{levels: make([]*tableNode, 10)}
+	tree.insert(writeTestTable(t, values, 256), 0, 0)
+	if tree.levels[0].table.meta.Load().filter == nil {
+		t.Fatal("filter is not loaded")
+	}
+
+	for _, value := range values {
+		if _, status := tree.Search(value.Key); status == kv.StatusNone {
+			t.Fatalf("Search(%s) = none", value.Key)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if _, status := tree.Search(fmt.Sprintf("missing%d", i)); status != kv.StatusNone {
+			t.Fatalf("Search(missing%d) = %d", i, status)
+		}
+	}
+	stats := tree.FilterStats()
+	if stats.Checks != 2000 || stats.Skipped+stats.FalsePositives != 1000 || stats.Skipped < 950 {
+		t.Fatalf("FilterStats() = %+v", stats)
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	// 测试结束后清除前缀提取器，其它测试不受影响
+	config.Reset()
+	config.Init(config.Config{PrefixExtractor: prefix.Delimited(":")})
+	t.Cleanup(config.Reset)
+
+	var values []kv.KV
+	for _, key := range []string{"t1:a", "t1:b", "t3:a", "t3:c", "u"} {
+		values = append(values, kv.KV{Key: key, Value: []byte(key), Status: kv.StatusSuccess})
+	}
+	tree := &TableTree{levels: make([]*tableNode, 10)}
+	table := writeTestTable(t, values, 16)
+	table.meta.Load().filter = nil
+	tree.insert(table, 0, 0)
+	if table.meta.Load().prefixFilter == nil {
+		t.Fatal("prefix filter is not loaded")
+	}
+
+	scan := func(p string) []string {
+		var keys []string
+		err := tree.ScanPrefix(p, func(value kv.KV) {
+			keys = append(keys, value.Key)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	if keys := scan("t1:"); len(keys) != 2 || keys[0] != "t1:a" || keys[1] != "t1:b" {
+		t.Fatalf("ScanPrefix(t1:) = %v", keys)
+	}
+	if keys := scan("t3:c"); len(keys) != 1 || keys[0] != "t3:c" {
+		t.Fatalf("ScanPrefix(t3:c) = %v", keys)
+	}
+	// 没有前缀的查找不能使用前缀过滤器
+	if keys := scan("t"); len(keys) != 4 {
+		t.Fatalf("ScanPrefix(t) = %v", keys)
+	}
+	if keys := scan("t2:"); len(keys) != 0 {
+		t.Fatalf("ScanPrefix(t2:) = %v", keys)
+	}
+	if _, status := tree.Search("t2:a"); status != kv.StatusNone {
+		t.Fatalf("Search(t2:a) = %d", status)
+	}
+	if stats := tree.FilterStats(); stats.PrefixChecks != 4 || stats.PrefixSkipped != 2 {
+		t.Fatalf("FilterStats() = %+v", stats)
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	var values []kv.KV
+	for i := 0; i < 1000; i++ {
+		values = append(values, kv.KV{
+			Key:    fmt.Sprintf("key%05d", i),
+			Value:  []byte(strings.Repeat("value", 20)),
+			Status: kv.StatusSuccess,
+		})
+	}
+	var sizes []int64
+	for _, c := range []compress.Type{compress.None, compress.Flate, compress.Zlib} {
+		table := writeTestTableOptions(t, values, writerOptions{blockSize: 1024, compression: c})
+		sizes = append(sizes, table.GetDbSize())
+		for _, value := range values {
+			got, status := table.Search(value.Key)
+			if status != kv.StatusSuccess || string(got.Value) != string(value.Value) {
+				t.Fatalf("compression %d: Search(%s) = %v, %d", c, value.Key, got, status)
+			}
+		}
+	}
+	if sizes[1] >= sizes[0]/2 || sizes[2] >= sizes[0]/2 {
+		t.Fatalf("table sizes %v, compressed tables should be much smaller", sizes)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	values := testValues(100)
+	table := writeTestTable(t, values, 256)
+	handle := table.meta.Load().index[1].handle
+	data, err := os.ReadFile(table.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 修改第二个数据块中重启点之前的最后一个字节，它属于最后一条记录的值
+	block := data[handle.offset : handle.offset+handle.size]
+	restarts := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	corrupted := append([]byte(nil), data...)
+	corrupted[handle.offset+handle.size-4*(restarts+1)-1] ^= 0xff
+	if err := os.WriteFile(table.filePath, corrupted, 0666); err != nil {
+		t.Fatal(err)
+	}
+	it := newBlockIterator(mustReadBlock(t, table, handle), true)
+	var key string
+	for it.Next() {
+		key = it.KV().Key
+	}
+	_, _, err = table.SearchWithOptions(key, ReadOptions{})
+	var corruption *CorruptionError
+	if !errors.Is(err, ErrCorruption) || !errors.As(err, &corruption) ||
+		corruption.File != table.filePath || corruption.Offset != int64(handle.offset) {
+		t.Fatalf("SearchWithOptions(%s) = %v", key, err)
+	}
+	if _, status, err := table.SearchWithOptions(key, ReadOptions{SkipChecksums: true}); err != nil || status == kv.StatusNone {
+		t.Fatalf("SearchWithOptions(%s) without checksums = %d, %v", key, status, err)
+	}
+	// 其它块不受影响
+	if _, status, err := table.SearchWithOptions(values[0].Key, ReadOptions{}); err != nil || status == kv.StatusNone {
+		t.Fatalf("SearchWithOptions(%s) = %d, %v", values[0].Key, status, err)
+	}
+
+	// 修改尾部
+	corrupted = append([]byte(nil), data...)
+	corrupted[len(corrupted)-footerLen] ^= 0xff
+	if err := os.WriteFile(table.filePath, corrupted, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.readMetaInfo(int64(len(corrupted))); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("readMetaInfo() = %v", err)
+	}
+}
+
+// 遍历时遇到损坏的块返回 ErrCorruption，不会终止进程
+func TestScanCorruption(t *testing.T) {
+	values := testValues(100)
+	table := writeTestTable(t, values, 256)
+	handle := table.meta.Load().index[1].handle
+	data, err := os.ReadFile(table.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[handle.offset] ^= 0xff
+	if err := os.WriteFile(table.filePath, corrupted, 0666); err != nil {
+		t.Fatal(err)
+	}
+	tree := &TableTree{levels: make([]*tableNode, 10)}
+	tree.insert(table, 0, 0)
+
+	count := 0
+	err = tree.ScanPrefix("", func(kv.KV) { count++ })
+	var corruption *CorruptionError
+	if !errors.Is(err, ErrCorruption) || !errors.As(err, &corruption) || corruption.Offset != int64(handle.offset) {
+		t.Fatalf("ScanPrefix() = %v", err)
+	}
+	// 第一个块在损坏之前已经遍历
+	if count == 0 || count >= len(values) {
+		t.Fatalf("scanned %d records before the corrupted block", count)
+	}
+}
+
+// 不检查校验和读取一个块
+func mustReadBlock(t *testing.T, table *SSTable, handle blockHandle) []byte {
+	t.Helper()
+	data, err := table.loadBlock(table.meta.Load().info, handle, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlockCache(t *testing.T) {
+	values := testValues(100)
+	table := writeTestTable(t, values, 256)
+	table.cache = cache.New(1 << 20)
+
+	key := values[1].Key
+	if _, _, err := table.SearchWithOptions(key, ReadOptions{NoFillCache: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, status, err := table.SearchWithOptions(key, ReadOptions{}); err != nil || status != kv.StatusSuccess {
+			t.Fatalf("SearchWithOptions(%s) = %d, %v", key, status, err)
+		}
+	}
+	// 第一次读取没有放入缓存，第二次读取放入缓存，之后命中
+	if stats := table.cache.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Usage == 0 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+}
+
+// 不检查校验和读取的块不能放入缓存，否则之后检查校验和的读取会拿到损坏的数据
+func TestSkipChecksumsBypassesCache(t *testing.T) {
+	values := testValues(100)
+	table := writeTestTable(t, values, 256)
+	table.cache = cache.New(1 << 20)
+	handle := table.meta.Load().index[1].handle
+	data, err := os.ReadFile(table.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := data[handle.offset : handle.offset+handle.size]
+	restarts := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	data[handle.offset+handle.size-4*(restarts+1)-1] ^= 0xff
+	if err := os.WriteFile(table.filePath, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	it := newBlockIterator(mustReadBlock(t, table, handle), true)
+	it.Next()
+	key := it.KV().Key
+	if _, _, err := table.SearchWithOptions(key, ReadOptions{SkipChecksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := table.cache.Stats(); stats.Usage != 0 {
+		t.Fatalf("Stats() = %+v, the unverified block was cached", stats)
+	}
+	if _, _, err := table.SearchWithOptions(key, ReadOptions{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("SearchWithOptions(%s) = %v, want %v", key, err, ErrCorruption)
+	}
+}
+
+func TestTableCache(t *testing.T) {
+	for _, dropMeta := range []bool{false, true} {
+		tables := newTableCache(2, dropMeta)
+		tree := &TableTree{levels: make([]*tableNode, 10), tables: tables}
+		var all [][]kv.KV
+		for i := 0; i < 5; i++ {
+			var values []kv.KV
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("t%d-%03d", i, j)
+				values = append(values, kv.KV{Key: key, Value: []byte(key), Status: kv.StatusSuccess})
+			}
+			table := writeTestTable(t, values, 256)
+			// 写入后关闭，第一次读取时再打开
+			if err := table.close(true); err != nil {
+				t.Fatal(err)
+			}
+			table.tables = tables
+			tree.insert(table, 0, i)
+			all = append(all, values)
+		}
+
+		for round := 0; round < 2; round++ {
+			for _, values := range all {
+				for _, value := range values {
+					got, status := tree.Search(value.Key)
+					if status != kv.StatusSuccess || string(got.Value) != value.Key {
+						t.Fatalf("Search(%s) = %v, %d", value.Key, got, status)
+					}
+				}
+			}
+		}
+
+		open, loaded := 0, 0
+		for node := tree.levels[0]; node != nil; node = node.next {
+			if node.table.file != nil {
+				open++
+			}
+			if node.table.meta.Load() != nil {
+				loaded++
+			}
+		}
+		if open > 2 || tables.len() > 2 {
+			t.Fatalf("%d files are open, want at most 2", open)
+		}
+		if dropMeta && loaded > 2 || !dropMeta && loaded != 5 {
+			t.Fatalf("dropMeta %v: %d tables have metadata", dropMeta, loaded)
+		}
+	}
+}
+
+// 默认保留关闭的文件的元数据，查找不存在的 key 时用布隆过滤器跳过，不重新打开文件
+func TestTableCacheNegativeLookup(t *testing.T) {
+	config.Reset()
+	config.Init(config.Config{MaxOpenFiles: 1})
+	t.Cleanup(config.Reset)
+	tree := &TableTree{}
+	tree.Init(t.TempDir())
+	var list []*SSTable
+	for i := 0; i < 2; i++ {
+		table := writeTestTable(t, testValues(50), 256)
+		table.tables = tree.tables
+		tree.insert(table, 0, i)
+		list = append(list, table)
+	}
+	// 读取第二个文件时关闭第一个文件
+	for _, table := range list {
+		if _, status := table.Search(testValues(50)[1].Key); status != kv.StatusSuccess {
+			t.Fatal("the table is empty")
+		}
+	}
+	if list[0].file != nil || list[0].meta.Load() == nil {
+		t.Fatal("the evicted table should be closed with its metadata kept")
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, status := tree.Search(fmt.Sprintf("missing-%03d", i)); status != kv.StatusNone {
+			t.Fatalf("Search(missing-%03d) = %d", i, status)
+		}
+	}
+	if stats := tree.FilterStats(); stats.FalsePositives == 0 && list[0].file != nil {
+		t.Fatalf("a negative lookup reopened the evicted table, stats = %+v", stats)
+	}
+}
+
+// 同一个 SSTable 的并发读取，同时有文件被关闭、重新打开
+func TestConcurrentReads(t *testing.T) {
+	values := testValues(500)
+	for _, mmap := range []bool{false, true} {
+		tables := newTableCache(1, true)
+		var list []*SSTable
+		for i := 0; i < 2; i++ {
+			table := writeTestTable(t, values, 256)
+			if err := table.close(true); err != nil {
+				t.Fatal(err)
+			}
+			table.mmap = mmap
+			table.tables = tables
+			list = append(list, table)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(table *SSTable) {
+				defer wg.Done()
+				for _, value := range values {
+					got, status, err := table.SearchWithOptions(value.Key, ReadOptions{})
+					if err != nil || status == kv.StatusNone || string(got.Value) != string(value.Value) {
+						t.Errorf("mmap %v: SearchWithOptions(%s) = %v, %d, %v", mmap, value.Key, got, status, err)
+						return
+					}
+				}
+			}(list[g%2])
+		}
+		wg.Wait()
+	}
+}
+
+func TestBlockRestarts(t *testing.T) {
+	var values []kv.KV
+	var flat []byte
+	for i := 0; i < 100; i++ {
+		value := kv.KV{Key: fmt.Sprintf("tenant/7/user/%05d", i*2), Value: []byte(fmt.Sprint(i)), Status: kv.StatusSuccess}
+		if i%7 == 0 {
+			value.Value, value.Status = nil, kv.StatusDeleted
+		}
+		values = append(values, value)
+		flat = kv.AppendEncode(flat, value)
+	}
+	// 查找 key 所在的记录，与 SSTable 中的查找方式相同
+	search := func(it *blockIterator, key string) (kv.KV, bool) {
+		it.seek(key)
+		for it.Next() {
+			if value := it.KV(); value.Key >= key {
+				return value, value.Key == key
+			}
+		}
+		return kv.KV{}, false
+	}
+
+	for _, interval := range []int{1, 2, 16, 1000} {
+		b := blockBuilder{restartInterval: interval}
+		for _, value := range values {
+			b.add(value)
+		}
+		data := b.finish()
+		if interval > 1 && len(data) >= len(flat) {
+			t.Fatalf("interval %d: block is %d bytes, flat records are %d", interval, len(data), len(flat))
+		}
+
+		it := newBlockIterator(data, true)
+		for i := 0; it.Next(); i++ {
+			if got := it.KV(); got.Key != values[i].Key || got.Status != values[i].Status || string(got.Value) != string(values[i].Value) {
+				t.Fatalf("interval %d: record %d = %v, want %v", interval, i, got, values[i])
+			}
+		}
+		if it.Err() != nil {
+			t.Fatalf("interval %d: %v", interval, it.Err())
+		}
+		for i, value := range values {
+			if got, ok := search(newBlockIterator(data, true), value.Key); !ok || got.Status != value.Status {
+				t.Fatalf("interval %d: search(%s) = %v, %v", interval, value.Key, got, ok)
+			}
+			missing := fmt.Sprintf("tenant/7/user/%05d", i*2+1)
+			if _, ok := search(newBlockIterator(data, true), missing); ok {
+				t.Fatalf("interval %d: search(%s) found", interval, missing)
+			}
+		}
+	}
+
+	// 版本 5 之前的块没有重启点
+	for _, value := range values {
+		if got, ok := search(newBlockIterator(flat, false), value.Key); !ok || got.Status != value.Status {
+			t.Fatalf("flat: search(%s) = %v, %v", value.Key, got, ok)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	values := testValues(2000)
+	dir := t.TempDir()
+	n := 0
+	w := NewWriter(WriterOptions{
+		TargetFileSize: 4 << 10,
+		NextPath: func() string {
+			n++
+			return path.Join(dir, fmt.Sprintf("1.%d.db", n))
+		},
+	})
+	for _, value := range values {
+		if err := w.Add(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Add(values[0]); err == nil {
+		t.Fatal("Add() accepted a key out of order")
+	}
+	paths, err := w.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 3 {
+		t.Fatalf("%d files, want the output to be split", len(paths))
+	}
+
+	// 文件之间的 key 不重叠，按顺序读出所有记录
+	i := 0
+	for _, filePath := range paths {
+		table := &SSTable{}
+		table.Init(filePath)
+		it := table.iterator(ReadOptions{})
+		for it.Next() {
+			if got := it.KV(); got.Key != values[i].Key || got.Status != values[i].Status {
+				t.Fatalf("%s: record %d = %v, want %v", filePath, i, got, values[i])
+			}
+			i++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		_ = table.close(true)
+	}
+	if i != len(values) {
+		t.Fatalf("read %d records, want %d", i, len(values))
+	}
+}
+
+// 写入失败时放弃写入，已经完成的文件和写了一半的文件都被删除
+func TestWriterAbort(t *testing.T) {
+	values := testValues(2000)
+	dir := t.TempDir()
+	n := 0
+	w := NewWriter(WriterOptions{
+		TargetFileSize: 4 << 10,
+		NextPath: func() string {
+			n++
+			return path.Join(dir, fmt.Sprintf("1.%d.db", n))
+		},
+	})
+	for _, value := range values[:1500] {
+		if err := w.Add(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n < 2 {
+		t.Fatalf("%d files, want the output to be split", n)
+	}
+	if err := w.Add(values[0]); err == nil {
+		t.Fatal("Add() accepted a key out of order")
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left after Abort()", len(files))
+	}
+}
+
+func TestMergeIterator(t *testing.T) {
+	var tables [3][]kv.KV
+	want := make(map[string]kv.KV)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		// 每个 key 出现在一个或多个 SSTable 中，后面的覆盖前面的
+		for j := range tables {
+			if (i+j)%(j+2) != 0 {
+				continue
+			}
+			value := kv.KV{Key: key, Value: []byte(fmt.Sprint(j)), Status: kv.StatusSuccess}
+			if i%5 == j {
+				value.Value, value.Status = nil, kv.StatusDeleted
+			}
+			tables[j] = append(tables[j], value)
+			want[key] = value
+		}
+	}
+	var its []*tableIterator
+	for _, values := range tables {
+		its = append(its, writeTestTable(t, values, 128).iterator(ReadOptions{}))
+	}
+
+	it := newMergeIterator(its)
+	last, n := "", 0
+	for it.Next() {
+		got := it.KV()
+		if got.Key <= last {
+			t.Fatalf("key %s after %s", got.Key, last)
+		}
+		if w := want[got.Key]; got.Status != w.Status || string(got.Value) != string(w.Value) {
+			t.Fatalf("%s = %v, want %v", got.Key, got, w)
+		}
+		last = got.Key
+		n++
+	}
+	if it.Err() != nil || n != len(want) {
+		t.Fatalf("merged %d keys, want %d, err %v", n, len(want), it.Err())
+	}
+}
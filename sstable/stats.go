@@ -0,0 +1,49 @@
+package sstable
+
+import (
+	"sync/atomic"
+
+	"github.com/lvtuwjl/tungdb/tung/cache"
+)
+
+// FilterStats 布隆过滤器的统计
+type FilterStats struct {
+	// 查找时检查布隆过滤器的次数
+	Checks uint64
+	// 布隆过滤器判断 key 不存在，跳过了 SSTable 的次数
+	Skipped uint64
+	// 布隆过滤器判断 key 可能存在，但是 SSTable 中没有这个 key 的次数
+	FalsePositives uint64
+	// 检查前缀布隆过滤器的次数
+	PrefixChecks uint64
+	// 前缀布隆过滤器判断前缀不存在，跳过了 SSTable 的次数
+	PrefixSkipped uint64
+}
+
+// TableTree 中的计数器
+type tableStats struct {
+	filterChecks         atomic.Uint64
+	filterSkipped        atomic.Uint64
+	filterFalsePositives atomic.Uint64
+	prefixChecks         atomic.Uint64
+	prefixSkipped        atomic.Uint64
+}
+
+// FilterStats 返回布隆过滤器的统计
+func (t *TableTree) FilterStats() FilterStats {
+	return FilterStats{
+		Checks:         t.stats.filterChecks.Load(),
+		Skipped:        t.stats.filterSkipped.Load(),
+		FalsePositives: t.stats.filterFalsePositives.Load(),
+		PrefixChecks:   t.stats.prefixChecks.Load(),
+		PrefixSkipped:  t.stats.prefixSkipped.Load(),
+	}
+}
+
+// BlockCacheStats 返回数据块缓存的统计，没有缓存时返回零值
+func (t *TableTree) BlockCacheStats() cache.Stats {
+	if t.cache == nil {
+		return cache.Stats{}
+	}
+	return t.cache.Stats()
+}
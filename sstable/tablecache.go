@@ -0,0 +1,73 @@
+package sstable
+
+import (
+	"container/list"
+	"log"
+	"sync"
+)
+
+// 限制同时打开的 SSTable 文件数量，超出时关闭最久没有读取的文件，
+// 被关闭的 SSTable 在下次读取时重新打开
+type tableCache struct {
+	mu sync.Mutex
+	// 最多打开的文件数量
+	capacity int
+	// 关闭文件时是否同时释放元数据
+	dropMeta bool
+	// 打开的 SSTable，最近读取的在前面
+	lru   *list.List
+	elems map[*SSTable]*list.Element
+}
+
+func newTableCache(capacity int, dropMeta bool) *tableCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tableCache{
+		capacity: capacity,
+		dropMeta: dropMeta,
+		lru:      list.New(),
+		elems:    make(map[*SSTable]*list.Element),
+	}
+}
+
+// 记录一次读取，打开的文件超出数量时关闭最久没有读取的
+func (c *tableCache) touch(t *SSTable) {
+	c.mu.Lock()
+	if elem, ok := c.elems[t]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.elems[t] = c.lru.PushFront(t)
+	}
+	var victims []*SSTable
+	for c.lru.Len() > c.capacity {
+		victim := c.lru.Remove(c.lru.Back()).(*SSTable)
+		delete(c.elems, victim)
+		victims = append(victims, victim)
+	}
+	c.mu.Unlock()
+
+	// 释放锁之后再关闭，正在读取被关闭文件的协程不会被阻塞在这里
+	for _, victim := range victims {
+		if err := victim.close(c.dropMeta); err != nil {
+			log.Println(" error close file,", victim.filePath, err)
+		}
+	}
+}
+
+// 删除 SSTable 之前移出，由调用者关闭文件
+func (c *tableCache) remove(t *SSTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[t]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, t)
+	}
+}
+
+// 当前打开的文件数量
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"os"
@@ -14,7 +15,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lvtuwjl/tungdb/tung/cache"
 	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/internal/fileutil"
 	"github.com/lvtuwjl/tungdb/tung/kv"
 )
 
@@ -23,6 +26,14 @@ type TableTree struct {
 	levels []*tableNode
 	// 用于避免进行插入或压缩，删除SSTable时发生冲突
 	mu sync.RWMutex
+	// 查找时的统计
+	stats tableStats
+	// 所有 SSTable 共享的数据块缓存
+	cache *cache.Cache
+	// 限制打开的 SSTable 文件数量，为空时不限制
+	tables *tableCache
+	// 打开 SSTable 文件时是否映射到内存
+	mmap bool
 }
 
 // 链表，表示每一层的SSTable
@@ -32,7 +43,7 @@ type tableNode struct {
 	next  *tableNode
 }
 
-func (t *TableTree) insert(table *SSTable, level int) int {
+func (t *TableTree) insert(table *SSTable, level int, index int) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -41,7 +52,7 @@ func (t *TableTree) insert(table *SSTable, level int) int {
 	newNode := &tableNode{
 		table: table,
 		next:  nil,
-		index: 0,
+		index: index,
 	}
 
 	if node == nil {
@@ -49,7 +60,6 @@ func (t *TableTree) insert(table *SSTable, level int) int {
 	} else {
 		for node != nil {
 			if node.next == nil {
-				newNode.index = node.index + 1
 				node.next = newNode
 				break
 			} else {
@@ -57,10 +67,30 @@ func (t *TableTree) insert(table *SSTable, level int) int {
 			}
 		}
 	}
-	return newNode.index
 }
 
+// 获取一层中下一个 SSTable 的序号
+func (t *TableTree) nextIndex(level int) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.levels[level] == nil {
+		return 0
+	}
+	return t.getMaxIndex(level) + 1
+}
+
+// Search 查找 key，读取失败时记录日志并返回 kv.StatusNone
 func (t *TableTree) Search(key string) (kv.KV, kv.Status) {
+	value, status, err := t.SearchWithOptions(key, ReadOptions{})
+	if err != nil {
+		log.Println(err)
+	}
+	return value, status
+}
+
+// SearchWithOptions 从新到旧查找 key，数据损坏时返回 ErrCorruption
+func (t *TableTree) SearchWithOptions(key string, opts ReadOptions) (kv.KV, kv.Status, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
@@ -75,18 +105,81 @@ func (t *TableTree) Search(key string) (kv.KV, kv.Status) {
 
 		// 查找的时候要从最后一个SSTable开始查找
 		for i := len(tables) - 1; i >= 0; i-- {
-			value, searchResult := tables[i].Search(key)
+			m, err := tables[i].metadata()
+			if err != nil {
+				return kv.KV{}, kv.StatusNone, err
+			}
+			// 布隆过滤器判断 key 不存在时跳过这个 SSTable
+			if !t.mayContain(m, key) {
+				continue
+			}
+			value, searchResult, err := tables[i].SearchWithOptions(key, opts)
+			if err != nil {
+				return kv.KV{}, kv.StatusNone, err
+			}
 			// 未找到 则查找下一个SSTable表
 			if searchResult == kv.StatusNone {
+				if m.filter != nil {
+					t.stats.filterFalsePositives.Add(1)
+				}
 				continue
 			} else {
 				// 如果找到或已被删除 则返回结果
-				return value, searchResult
+				return value, searchResult, nil
 			}
 		}
 	}
 
-	return kv.KV{}, kv.StatusNone
+	return kv.KV{}, kv.StatusNone, nil
+}
+
+// 用布隆过滤器判断 SSTable 中是否可能有 key，同时更新统计
+func (t *TableTree) mayContain(m *tableMeta, key string) bool {
+	if m.filter != nil {
+		t.stats.filterChecks.Add(1)
+		if !m.filter.MayContain(key) {
+			t.stats.filterSkipped.Add(1)
+			return false
+		}
+	}
+	if m.prefixFilter != nil && m.extractor.InDomain(key) {
+		t.stats.prefixChecks.Add(1)
+		if !m.prefixFilter.MayContain(m.extractor.Transform(key)) {
+			t.stats.prefixSkipped.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// ScanPrefix 从旧到新遍历所有 SSTable 中以 prefix 开头的记录，包括删除标记，
+// 同一个 key 较新的记录在后面，应当覆盖之前的记录。数据损坏时返回 ErrCorruption
+func (t *TableTree) ScanPrefix(prefix string, fn func(kv.KV)) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// 层数越大越旧，同一层中序号越小越旧
+	for level := len(t.levels) - 1; level >= 0; level-- {
+		for node := t.levels[level]; node != nil; node = node.next {
+			table := node.table
+			m, err := table.metadata()
+			if err != nil {
+				return err
+			}
+			// prefix 有前缀时，所有以它开头的 key 都有相同的前缀
+			if m.prefixFilter != nil && m.extractor.InDomain(prefix) {
+				t.stats.prefixChecks.Add(1)
+				if !m.prefixFilter.MayContain(m.extractor.Transform(prefix)) {
+					t.stats.prefixSkipped.Add(1)
+					continue
+				}
+			}
+			if err := table.scanPrefix(prefix, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // 获取一层中的 SSTable的最大序号
@@ -122,71 +215,81 @@ func getLevel(name string) (level int, index int, err error) {
 
 // 创建新的SSTable
 func (t *TableTree) CreateNewTable(values []kv.KV) {
-	t.createTable(values, 0)
+	t.CreateTableFrom(&sliceIterator{values: values})
 }
 
-// 创建新的SSTable，插入到合适的层
-func (t *TableTree) createTable(values []kv.KV, level int) *SSTable {
-	// 生成数据区
-	keys := make([]string, 0, len(values))
-	positions := make(map[string]Position)
-	dataArea := make([]byte, 0)
-	for _, value := range values {
-		data, err := kv.Encode(value)
-		if err != nil {
-			log.Println("Failed to insert Key: ", value.Key, err)
-			continue
-		}
+// CreateTableFrom 将迭代器中按 key 升序排列的记录写入新的 SSTable，放在第 0 层
+func (t *TableTree) CreateTableFrom(it Iterator) {
+	t.createTable(it, 0)
+}
 
-		keys = append(keys, value.Key)
-		// 文件定位记录
-		positions[value.Key] = Position{
-			Start:   int64(len(dataArea)),
-			Len:     int64(len(data)),
-			Deleted: value.Status == kv.StatusDeleted,
+// 创建新的SSTable，插入到合适的层，记录边读取边写入文件，不会全部放在内存中
+func (t *TableTree) createTable(it Iterator, level int) {
+	w := t.newWriter(level, 0)
+	for it.Next() {
+		if err := w.Add(it.KV()); err != nil {
+			// 删除写了一半的文件，重启后不会被当作 SSTable 加载
+			_ = w.Abort()
+			log.Fatal("error write file,", err)
 		}
-		dataArea = append(dataArea, data...)
 	}
-	sort.Strings(keys)
-
-	// 生成稀疏索引区
-	// map[string]Position to json
-	indexArea, err := json.Marshal(positions)
+	paths, err := w.Finish()
 	if err != nil {
-		log.Fatal("An SSTable file cannot be created,", err)
+		_ = w.Abort()
+		log.Fatal("error write file,", err)
 	}
+	t.addTables(paths, level)
+}
 
-	// 生成MetaInfo
-	meta := MetaInfo{
-		version:    0,
-		dataStart:  0,
-		dataLen:    int64(len(dataArea)),
-		indexStart: int64(len(dataArea)),
-		indexLen:   int64(len(indexArea)),
-	}
+// 创建写入第 level 层的 Writer，生成的文件按序号依次命名
+func (t *TableTree) newWriter(level int, targetFileSize int64) *Writer {
+	index := t.nextIndex(level)
+	dir := config.GetConfig().DataDir
+	return NewWriter(WriterOptions{
+		Level:          level,
+		TargetFileSize: targetFileSize,
+		NextPath: func() string {
+			log.Printf("Create a new SSTable,level: %d ,index: %d\r\n", level, index)
+			filePath := dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
+			index++
+			return filePath
+		},
+	})
+}
 
-	table := &SSTable{
-		tableMetaInfo: meta,
-		sparseIndex:   positions,
-		sortIndex:     keys,
-		mu:            sync.Mutex{},
+// 文件落盘后再加入 TableTree，避免查询到未写完的 SSTable
+func (t *TableTree) addTables(paths []string, level int) {
+	for _, filePath := range paths {
+		_, index, err := getLevel(filepath.Base(filePath))
+		if err != nil {
+			log.Fatal(err)
+		}
+		table := t.newTable(filePath)
+		// 新的 SSTable 很可能马上被查询，提前加载元数据
+		if _, err := table.metadata(); err != nil {
+			log.Println(" error open file ", filePath)
+			panic(err)
+		}
+		t.insert(table, level, index)
 	}
+}
 
-	index := t.insert(table, level)
-	log.Printf("Create a new SSTable,level: %d ,index: %d\r\n", level, index)
-	con := config.GetConfig()
-	filePath := con.DataDir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
-	table.filePath = filePath
+// 遍历按 key 升序排列的记录
+type sliceIterator struct {
+	values []kv.KV
+	cur    kv.KV
+}
 
-	writeDataToFile(filePath, dataArea, indexArea, meta)
-	// 以只读的形式打开文件
-	f, err := os.OpenFile(table.filePath, os.O_RDONLY, 0666)
-	if err != nil {
-		log.Panicln("error open file", table.filePath)
+func (it *sliceIterator) Next() bool {
+	if len(it.values) == 0 {
+		return false
 	}
-	table.file = f
+	it.cur, it.values = it.values[0], it.values[1:]
+	return true
+}
 
-	return table
+func (it *sliceIterator) KV() kv.KV {
+	return it.cur
 }
 
 // 获取指定层的SSTable总大小
@@ -200,39 +303,6 @@ func (t *TableTree) GetLevelSize(level int) int64 {
 	return size
 }
 
-func writeDataToFile(filePath string, dataArea []byte, indexArea []byte, meta MetaInfo) {
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Fatal("error create file,", err)
-	}
-	_, err = f.Write(dataArea)
-	if err != nil {
-		log.Fatal("error write file,", err)
-	}
-
-	_, err = f.Write(indexArea)
-	if err != nil {
-		log.Fatal("error write file,", err)
-	}
-
-	// 写入元数据到文件末尾
-	// 注意 右侧必须能够识别字节长度的类型 不能使用int这种类型 只能使用int32 int64等
-	_ = binary.Write(f, binary.LittleEndian, &meta.version)
-	_ = binary.Write(f, binary.LittleEndian, &meta.dataStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.dataLen)
-	_ = binary.Write(f, binary.LittleEndian, &meta.indexStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.indexLen)
-
-	err = f.Sync()
-	if err != nil {
-		log.Fatal("err write file,", err)
-	}
-	err = f.Close()
-	if err != nil {
-		log.Fatal("error close file,", err)
-	}
-}
-
 // 加载一个 db 文件到 TableTree 中
 func (tree *TableTree) loadDbFile(path string) {
 	log.Println("Loading the ", path)
@@ -246,8 +316,8 @@ func (tree *TableTree) loadDbFile(path string) {
 	if err != nil {
 		return
 	}
-	table := &SSTable{}
-	table.Init(path)
+	// 第一次读取时才打开文件、加载元数据
+	table := tree.newTable(path)
 	newNode := &tableNode{
 		index: index,
 		table: table,
@@ -277,97 +347,193 @@ func (tree *TableTree) loadDbFile(path string) {
 	}
 }
 
-// 加载文件句柄
-func (table *SSTable) loadFileHandle() {
-	if table.file == nil {
-		// 以只读的形式打开文件
-		f, err := os.OpenFile(table.filePath, os.O_RDONLY, 0666)
-		if err != nil {
-			log.Println(" error open file ", table.filePath)
-			panic(err)
-		}
+// 创建一个还没有打开的 SSTable
+func (tree *TableTree) newTable(path string) *SSTable {
+	return &SSTable{
+		filePath: path,
+		id:       cache.NewFileID(),
+		cache:    tree.cache,
+		tables:   tree.tables,
+		mmap:     tree.mmap,
+	}
+}
 
-		table.file = f
+// 返回表的元数据，还没有加载或者已经被释放时从文件中加载
+func (table *SSTable) metadata() (*tableMeta, error) {
+	if m := table.meta.Load(); m != nil {
+		return m, nil
+	}
+	table.loadMu.Lock()
+	defer table.loadMu.Unlock()
+	if m := table.meta.Load(); m != nil {
+		return m, nil
+	}
+	m, err := table.loadMeta()
+	if err != nil {
+		return nil, err
 	}
-	// 加载文件句柄的同时，加载表的元数据
-	table.loadMetaInfo()
-	table.loadSparseIndex()
+	table.meta.Store(m)
+	return m, nil
 }
 
-// 加载 SSTable 文件的元数据，从 SSTable 磁盘文件中读取出 TableMetaInfo
-func (table *SSTable) loadMetaInfo() {
-	f := table.file
-	_, err := f.Seek(0, 0)
+// 加载 SSTable 文件的元数据，从 SSTable 磁盘文件中读取出 TableMetaInfo 和索引
+// 以 tableMagic 结尾的是块格式，否则是旧格式
+func (table *SSTable) loadMeta() (*tableMeta, error) {
+	info, err := os.Stat(table.filePath)
 	if err != nil {
-		log.Println(" error open file ", table.filePath)
-		panic(err)
+		return nil, err
 	}
-	info, _ := f.Stat()
-	_, err = f.Seek(info.Size()-8*5, 0)
+	meta, err := table.readMetaInfo(info.Size())
 	if err != nil {
-		log.Println("Error reading metadata ", table.filePath)
-		panic(err)
+		return nil, err
+	}
+	m := &tableMeta{info: meta}
+	if meta.blockBased() {
+		err = table.loadIndex(m)
+	} else {
+		err = table.loadSparseIndex(m)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &table.tableMetaInfo.version)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	_, err = f.Seek(info.Size()-8*4, 0)
+func (table *SSTable) readMetaInfo(size int64) (MetaInfo, error) {
+	if size >= footerLen {
+		buf, err := table.read(size-footerLen, footerLen)
+		if err != nil {
+			return MetaInfo{}, err
+		}
+		if binary.LittleEndian.Uint64(buf[footerLen-8:]) == tableMagic {
+			meta := decodeFooter(buf)
+			if meta.hasChecksum() {
+				offset := size - footerLen - footerChecksumLen
+				if offset < 0 {
+					return meta, table.corruption(0, "file is too short")
+				}
+				sum, err := table.read(offset, 4)
+				if err != nil {
+					return meta, err
+				}
+				if crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(sum) {
+					return meta, table.corruption(offset, "footer checksum mismatch")
+				}
+			}
+			// 块的位置必须在尾部之前
+			for _, handle := range []blockHandle{meta.metaindex, meta.index} {
+				if handle.offset+handle.size > uint64(size-footerLen) {
+					return meta, table.corruption(size-footerLen, "block handle is out of range")
+				}
+			}
+			return meta, nil
+		}
+	}
+	if size < legacyMetaLen {
+		return MetaInfo{}, table.corruption(0, "file is too short")
+	}
+	buf, err := table.read(size-legacyMetaLen, legacyMetaLen)
 	if err != nil {
-		log.Println("Error reading metadata ", table.filePath)
-		panic(err)
+		return MetaInfo{}, err
+	}
+	meta := decodeLegacyMeta(buf)
+	if meta.version > tableVersionBinary || meta.indexStart < 0 || meta.indexLen < 0 ||
+		meta.indexStart+meta.indexLen > size-legacyMetaLen {
+		return meta, table.corruption(size-legacyMetaLen, "invalid metadata")
 	}
-	_ = binary.Read(f, binary.LittleEndian, &table.tableMetaInfo.dataStart)
+	return meta, nil
+}
 
-	_, err = f.Seek(info.Size()-8*3, 0)
+// 加载块格式的索引块和元数据索引块，每个数据块在内存中只占用一项
+func (table *SSTable) loadIndex(m *tableMeta) error {
+	entries, err := table.readHandles(m, m.info.index)
 	if err != nil {
-		log.Println("Error reading metadata ", table.filePath)
-		panic(err)
+		return err
 	}
-	_ = binary.Read(f, binary.LittleEndian, &table.tableMetaInfo.dataLen)
+	m.index = entries
 
-	_, err = f.Seek(info.Size()-8*2, 0)
+	entries, err = table.readHandles(m, m.info.metaindex)
 	if err != nil {
-		log.Println("Error reading metadata ", table.filePath)
-		panic(err)
+		return err
+	}
+	m.metaindex = make(map[string]blockHandle, len(entries))
+	for _, entry := range entries {
+		m.metaindex[entry.separator] = entry.handle
+	}
+
+	// 布隆过滤器常驻内存
+	if m.filter, err = table.readMetaBlock(m, filterBlockName); err != nil {
+		return err
+	}
+	// 前缀提取器改变后，旧的前缀过滤器不再可用
+	if extractor := config.GetConfig().PrefixExtractor; extractor != nil {
+		name, err := table.readMetaBlock(m, prefixExtractorBlockName)
+		if err != nil {
+			return err
+		}
+		if name != nil && string(name) == extractor.Name() {
+			if m.prefixFilter, err = table.readMetaBlock(m, prefixFilterBlockName); err != nil {
+				return err
+			}
+			m.extractor = extractor
+		}
+	}
+	return nil
+}
+
+// 读取元数据索引块中名为 name 的块，不存在时返回 nil
+func (table *SSTable) readMetaBlock(m *tableMeta, name string) ([]byte, error) {
+	handle, ok := m.metaindex[name]
+	if !ok {
+		return nil, nil
 	}
-	_ = binary.Read(f, binary.LittleEndian, &table.tableMetaInfo.indexStart)
+	return table.readBlock(m, handle, ReadOptions{NoFillCache: true})
+}
 
-	_, err = f.Seek(info.Size()-8*1, 0)
+// 读取一个记录了块位置的块
+func (table *SSTable) readHandles(m *tableMeta, handle blockHandle) ([]indexEntry, error) {
+	data, err := table.readBlock(m, handle, ReadOptions{NoFillCache: true})
 	if err != nil {
-		log.Println("Error reading metadata ", table.filePath)
-		panic(err)
+		return nil, err
+	}
+	var entries []indexEntry
+	it := newBlockIterator(data, m.info.prefixKeys())
+	for it.Next() {
+		h, err := decodeBlockHandle(it.KV().Value)
+		if err != nil {
+			return nil, table.corruption(int64(handle.offset), err.Error())
+		}
+		entries = append(entries, indexEntry{separator: it.KV().Key, handle: h})
 	}
-	_ = binary.Read(f, binary.LittleEndian, &table.tableMetaInfo.indexLen)
+	if err := it.Err(); err != nil {
+		return nil, table.corruption(int64(handle.offset), err.Error())
+	}
+	return entries, nil
 }
 
-// 加载稀疏索引区到内存
-func (table *SSTable) loadSparseIndex() {
+// 加载旧格式的稀疏索引区到内存
+func (table *SSTable) loadSparseIndex(m *tableMeta) error {
 	// 加载稀疏索引区
-	bytes := make([]byte, table.tableMetaInfo.indexLen)
-	if _, err := table.file.Seek(table.tableMetaInfo.indexStart, 0); err != nil {
-		log.Println(" error open file ", table.filePath)
-		panic(err)
-	}
-	if _, err := table.file.Read(bytes); err != nil {
-		log.Println(" error open file ", table.filePath)
-		panic(err)
+	bytes, err := table.read(m.info.indexStart, m.info.indexLen)
+	if err != nil {
+		return err
 	}
 
 	// 反序列化到内存
-	table.sparseIndex = make(map[string]Position)
-	err := json.Unmarshal(bytes, &table.sparseIndex)
+	m.sparseIndex = make(map[string]Position)
+	err = json.Unmarshal(bytes, &m.sparseIndex)
 	if err != nil {
-		log.Println(" error open file ", table.filePath)
-		panic(err)
+		return table.corruption(m.info.indexStart, err.Error())
 	}
-	_, _ = table.file.Seek(0, 0)
 
 	// 先排序
-	keys := make([]string, 0, len(table.sparseIndex))
-	for k := range table.sparseIndex {
+	keys := make([]string, 0, len(m.sparseIndex))
+	for k := range m.sparseIndex {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	table.sortIndex = keys
+	m.sortIndex = keys
+	return nil
 }
 
 var levelMaxSize []int
@@ -395,6 +561,16 @@ func (tree *TableTree) Init(dir string) {
 	levelMaxSize[8] = levelMaxSize[7] * 10
 	levelMaxSize[9] = levelMaxSize[8] * 10
 
+	tree.cache = con.BlockCache
+	if tree.cache == nil && con.BlockCacheSize > 0 {
+		tree.cache = cache.New(con.BlockCacheSize)
+	}
+
+	tree.mmap = con.MmapReads
+	if con.MaxOpenFiles > 0 {
+		tree.tables = newTableCache(con.MaxOpenFiles, con.DropTableMetadata)
+	}
+
 	tree.levels = make([]*tableNode, 10)
 	//tree.lock = &sync.RWMutex{}
 	infos, err := ioutil.ReadDir(dir)
@@ -409,3 +585,46 @@ func (tree *TableTree) Init(dir string) {
 		}
 	}
 }
+
+// Checkpoint 将所有的 SSTable 文件链接到 dir 中
+func (tree *TableTree) Checkpoint(dir string) error {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	for _, node := range tree.levels {
+		for node != nil {
+			dst := path.Join(dir, filepath.Base(node.table.filePath))
+			if err := linkOrCopy(node.table.filePath, dst); err != nil {
+				return err
+			}
+			node = node.next
+		}
+	}
+	return fileutil.SyncDir(dir)
+}
+
+// CopyTables 将 srcDir 中所有的 SSTable 文件链接到 dstDir 中
+func CopyTables(srcDir string, dstDir string) error {
+	infos, err := os.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if path.Ext(info.Name()) != ".db" {
+			continue
+		}
+		if err := linkOrCopy(path.Join(srcDir, info.Name()), path.Join(dstDir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return fileutil.SyncDir(dstDir)
+}
+
+// SSTable 文件写入后不再修改，可以直接创建硬链接；
+// 无法创建硬链接时（例如不在同一个文件系统）改为复制
+func linkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return fileutil.CopyFile(src, dst)
+}
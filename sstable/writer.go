@@ -0,0 +1,361 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lvtuwjl/tungdb/tung/bloom"
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/internal/fileutil"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/prefix"
+)
+
+// 元数据索引块中元数据块的名称
+const (
+	// 所有 key 的布隆过滤器
+	filterBlockName = "filter.bloom"
+	// 所有 key 前缀的布隆过滤器
+	prefixFilterBlockName = "filter.prefix"
+	// 生成前缀过滤器的前缀提取器的名称
+	prefixExtractorBlockName = "prefix.extractor"
+)
+
+// 生成 SSTable 的选项
+type writerOptions struct {
+	// 数据块的大小，小于等于 0 时使用默认值
+	blockSize int
+	// 块中每隔多少条记录设置一个重启点，小于等于 0 时使用默认值
+	restartInterval int
+	// 布隆过滤器中每个 key 占用的位数，小于等于 0 时不生成布隆过滤器
+	bloomBitsPerKey int
+	// 前缀提取器，为空时不生成前缀过滤器
+	prefixExtractor prefix.Extractor
+	// 数据块和索引块的压缩算法
+	compression compress.Type
+}
+
+// 从配置中读取生成第 level 层 SSTable 的选项
+func defaultWriterOptions(level int) writerOptions {
+	con := config.GetConfig()
+	opts := writerOptions{
+		blockSize:       con.BlockSize,
+		restartInterval: con.BlockRestartInterval,
+		bloomBitsPerKey: con.BloomBitsPerKey,
+		prefixExtractor: con.PrefixExtractor,
+	}
+	if n := len(con.TableCompression); n > 0 {
+		opts.compression = con.TableCompression[min(level, n-1)]
+	}
+	if opts.bloomBitsPerKey == 0 {
+		opts.bloomBitsPerKey = bloom.DefaultBitsPerKey
+	}
+	return opts
+}
+
+// 按 key 升序写入记录，生成块格式的 SSTable
+type tableWriter struct {
+	w         *bufio.Writer
+	offset    uint64
+	blockSize int
+	// 数据块和索引块的压缩算法，以及压缩时复用的缓冲区
+	compressor compress.Compressor
+	compressed []byte
+
+	data  blockBuilder
+	index blockBuilder
+	// 上一个数据块写入后，等到下一个块的第一个 key 才能确定分隔 key
+	pendingIndex  bool
+	pendingHandle blockHandle
+
+	// 所有 key 的布隆过滤器，包括删除标记
+	filter *bloom.Builder
+	// key 前缀的布隆过滤器，key 有序，相同的前缀是连续的，只需要添加一次
+	extractor    prefix.Extractor
+	prefixFilter *bloom.Builder
+	lastPrefix   string
+
+	lastKey string
+	count   int
+}
+
+func newTableWriter(w io.Writer, opts writerOptions) (*tableWriter, error) {
+	compressor, err := compress.Get(opts.compression)
+	if err != nil {
+		return nil, err
+	}
+	t := &tableWriter{
+		w:          bufio.NewWriter(w),
+		blockSize:  opts.blockSize,
+		compressor: compressor,
+	}
+	if t.blockSize <= 0 {
+		t.blockSize = defaultBlockSize
+	}
+	t.data.restartInterval = opts.restartInterval
+	t.index.restartInterval = opts.restartInterval
+	if opts.bloomBitsPerKey > 0 {
+		t.filter = bloom.NewBuilder(opts.bloomBitsPerKey)
+	}
+	if opts.prefixExtractor != nil {
+		t.extractor = opts.prefixExtractor
+		t.prefixFilter = bloom.NewBuilder(opts.bloomBitsPerKey)
+	}
+	return t, nil
+}
+
+// 写入一条记录，key 必须大于之前写入的 key
+func (t *tableWriter) add(value kv.KV) error {
+	if t.count > 0 && value.Key <= t.lastKey {
+		return fmt.Errorf("sstable: key %q added after %q", value.Key, t.lastKey)
+	}
+	if t.pendingIndex {
+		t.addIndex(shortSeparator(t.lastKey, value.Key))
+	}
+
+	t.data.add(value)
+	if t.filter != nil {
+		t.filter.Add(value.Key)
+	}
+	if t.extractor != nil && t.extractor.InDomain(value.Key) {
+		p := t.extractor.Transform(value.Key)
+		if t.prefixFilter.Len() == 0 || p != t.lastPrefix {
+			t.prefixFilter.Add(p)
+			t.lastPrefix = p
+		}
+	}
+	t.lastKey = value.Key
+	t.count++
+	if t.data.estimatedSize() >= t.blockSize {
+		return t.flushBlock()
+	}
+	return nil
+}
+
+// 写入当前的数据块
+func (t *tableWriter) flushBlock() error {
+	if t.data.empty() {
+		return nil
+	}
+	handle, err := t.writeBlock(t.data.finish(), t.compressor)
+	if err != nil {
+		return err
+	}
+	t.data.reset()
+	t.pendingIndex = true
+	t.pendingHandle = handle
+	return nil
+}
+
+func (t *tableWriter) addIndex(separator string) {
+	t.index.add(kv.KV{
+		Key:    separator,
+		Value:  t.pendingHandle.encode(),
+		Status: kv.StatusSuccess,
+	})
+	t.pendingIndex = false
+}
+
+// 写入一个块和块尾部，压缩后没有明显变小时不压缩
+func (t *tableWriter) writeBlock(data []byte, c compress.Compressor) (blockHandle, error) {
+	kind := compress.None
+	if c.Type() != compress.None {
+		compressed, err := c.Compress(t.compressed[:0], data)
+		if err != nil {
+			return blockHandle{}, err
+		}
+		t.compressed = compressed
+		// 至少节省 1/8 才使用压缩后的数据
+		if len(compressed) < len(data)-len(data)/8 {
+			data, kind = compressed, c.Type()
+		}
+	}
+
+	handle := blockHandle{offset: t.offset, size: uint64(len(data))}
+	if _, err := t.w.Write(data); err != nil {
+		return handle, err
+	}
+	// 校验和覆盖块的内容和压缩算法
+	var trailer [blockTrailerLen]byte
+	trailer[0] = byte(kind)
+	crc := crc32.Update(crc32.Checksum(data, crcTable), crcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], crc)
+	if _, err := t.w.Write(trailer[:]); err != nil {
+		return handle, err
+	}
+	t.offset += uint64(len(data)) + blockTrailerLen
+	return handle, nil
+}
+
+// 写入不压缩的元数据块
+func (t *tableWriter) writeMetaBlock(metaindex *blockBuilder, name string, data []byte) error {
+	none, _ := compress.Get(compress.None)
+	handle, err := t.writeBlock(data, none)
+	if err != nil {
+		return err
+	}
+	metaindex.add(kv.KV{Key: name, Value: handle.encode(), Status: kv.StatusSuccess})
+	return nil
+}
+
+// 写入剩余的数据块、元数据索引块、索引块和尾部，返回文件的元数据
+func (t *tableWriter) finish() (MetaInfo, error) {
+	meta := MetaInfo{version: currentTableVersion}
+	if err := t.flushBlock(); err != nil {
+		return meta, err
+	}
+	// 最后一个块使用它最大的 key 作为分隔 key
+	if t.pendingIndex {
+		t.addIndex(t.lastKey)
+	}
+	meta.dataLen = int64(t.offset)
+
+	// 元数据块写在数据块之后，元数据索引块按名称记录它们的位置
+	var metaindex blockBuilder
+	if t.filter != nil {
+		if err := t.writeMetaBlock(&metaindex, filterBlockName, t.filter.Finish()); err != nil {
+			return meta, err
+		}
+	}
+	if t.extractor != nil {
+		if err := t.writeMetaBlock(&metaindex, prefixFilterBlockName, t.prefixFilter.Finish()); err != nil {
+			return meta, err
+		}
+		if err := t.writeMetaBlock(&metaindex, prefixExtractorBlockName, []byte(t.extractor.Name())); err != nil {
+			return meta, err
+		}
+	}
+
+	none, _ := compress.Get(compress.None)
+	var err error
+	if meta.metaindex, err = t.writeBlock(metaindex.finish(), none); err != nil {
+		return meta, err
+	}
+	if meta.index, err = t.writeBlock(t.index.finish(), t.compressor); err != nil {
+		return meta, err
+	}
+	meta.indexStart = int64(meta.index.offset)
+	meta.indexLen = int64(meta.index.size)
+	if _, err := t.w.Write(encodeFooter(meta)); err != nil {
+		return meta, err
+	}
+	return meta, t.w.Flush()
+}
+
+// WriterOptions 流式生成 SSTable 的选项
+type WriterOptions struct {
+	// 生成的 SSTable 所在的层，用于选择压缩算法
+	Level int
+	// 单个文件的目标大小，单位字节，达到后从下一条记录开始写入新的文件，小于等于 0 时不切分
+	TargetFileSize int64
+	// 返回下一个文件的路径，每个文件调用一次
+	NextPath func() string
+}
+
+// Writer 按 key 升序流式写入记录，数据块写满后立即写入文件，
+// 内存中只保留当前的数据块、索引和过滤器；文件达到目标大小时切换到新的文件
+type Writer struct {
+	opts WriterOptions
+	// 正在写入的文件，还没有写入记录时为空
+	file  *os.File
+	path  string
+	table *tableWriter
+	// 已经完成的文件，按 key 升序排列
+	paths []string
+
+	lastKey string
+	count   int
+}
+
+// NewWriter 创建 Writer，第一条记录写入时才创建文件
+func NewWriter(opts WriterOptions) *Writer {
+	return &Writer{opts: opts}
+}
+
+// Add 写入一条记录，key 必须大于之前写入的 key
+func (w *Writer) Add(value kv.KV) error {
+	if w.count > 0 && value.Key <= w.lastKey {
+		return fmt.Errorf("sstable: key %q added after %q", value.Key, w.lastKey)
+	}
+	if w.table == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if err := w.table.add(value); err != nil {
+		return err
+	}
+	w.lastKey = value.Key
+	w.count++
+	if w.opts.TargetFileSize > 0 && int64(w.table.offset) >= w.opts.TargetFileSize {
+		return w.finishFile()
+	}
+	return nil
+}
+
+// Finish 写入最后一个文件的索引、过滤器和尾部，返回生成的所有文件，按 key 升序排列；
+// 没有写入记录时不生成文件
+func (w *Writer) Finish() ([]string, error) {
+	if w.table != nil {
+		if err := w.finishFile(); err != nil {
+			return w.paths, err
+		}
+	}
+	return w.paths, nil
+}
+
+// Abort 放弃写入，删除已经生成的文件
+func (w *Writer) Abort() error {
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.paths = append(w.paths, w.path)
+		w.file, w.table = nil, nil
+	}
+	for _, p := range w.paths {
+		if removeErr := os.Remove(p); err == nil {
+			err = removeErr
+		}
+	}
+	w.paths = nil
+	return err
+}
+
+func (w *Writer) open() error {
+	w.path = w.opts.NextPath()
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	table, err := newTableWriter(f, defaultWriterOptions(w.opts.Level))
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(w.path)
+		return err
+	}
+	w.file, w.table = f, table
+	return nil
+}
+
+// 写入当前文件的索引和尾部并同步到磁盘
+func (w *Writer) finishFile() error {
+	if _, err := w.table.finish(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.paths = append(w.paths, w.path)
+	w.file, w.table = nil, nil
+	// 同步目录，保证新文件在崩溃后仍然存在
+	return fileutil.SyncDir(filepath.Dir(w.path))
+}
@@ -0,0 +1,16 @@
+package tung
+
+import (
+	"github.com/lvtuwjl/tungdb/tung/cache"
+	"github.com/lvtuwjl/tungdb/tung/sstable"
+)
+
+// FilterStats 返回 SSTable 布隆过滤器的统计
+func FilterStats() sstable.FilterStats {
+	return database.TableTree.FilterStats()
+}
+
+// BlockCacheStats 返回 SSTable 数据块缓存的统计
+func BlockCacheStats() cache.Stats {
+	return database.TableTree.BlockCacheStats()
+}
@@ -0,0 +1,160 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/internal/fileutil"
+)
+
+// ErrArchived 归档目录中已经有同一编号的段，例如由检查点恢复的数据库和原来的数据库使用了同一个归档目录
+var ErrArchived = errors.New("wal: segment is already archived")
+
+// RestoreTarget 按时间点恢复的目标，两个条件都为零值时恢复所有归档的写入
+type RestoreTarget struct {
+	// 恢复到这个序号为止（包含）
+	Seq uint64
+	// 恢复到这个时间为止（包含）
+	Time time.Time
+}
+
+// 记录是否超出了恢复目标
+func (t RestoreTarget) exceeded(record Record) bool {
+	if t.Seq != 0 && record.Seq > t.Seq {
+		return true
+	}
+	if !t.Time.IsZero() && record.Time.After(t.Time) {
+		return true
+	}
+	return false
+}
+
+// Restore 将检查点中的段复制到 dir 中，再从归档目录中回放序号大于 after 的写入，直到超出恢复目标，
+// 这些写入被写入 dir 中的一个新段，数据库启动时会回放它。返回恢复的最后一条写入的序号
+func Restore(checkpointDir string, archiveDir string, dir string, after uint64, target RestoreTarget) (uint64, error) {
+	existing, err := listSegments(checkpointDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range existing {
+		if err := fileutil.CopyFile(segmentPath(checkpointDir, n), segmentPath(dir, n)); err != nil {
+			return 0, err
+		}
+	}
+	archived, err := listSegments(archiveDir)
+	if err != nil {
+		return 0, err
+	}
+	num := uint64(1)
+	if n := len(existing); n > 0 {
+		num = existing[n-1] + 1
+	}
+
+	segPath := segmentPath(dir, num)
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Write(segmentHeader(after + 1)); err != nil {
+		return 0, err
+	}
+
+	none, _ := compress.Get(compress.None)
+	last := after
+	for _, n := range archived {
+		done, err := readArchivedSegment(segmentPath(archiveDir, n), func(record Record) (bool, error) {
+			if record.Seq <= last {
+				return true, nil
+			}
+			if target.exceeded(record) {
+				return false, nil
+			}
+			if record.Seq != last+1 {
+				return false, fmt.Errorf("wal: missing archived records between %d and %d", last, record.Seq)
+			}
+			data := encodeBatch([][]byte{encodeEntry(record.KV)}, record.Seq, record.Time, none)
+			if _, err := f.Write(data); err != nil {
+				return false, err
+			}
+			last = record.Seq
+			return true, nil
+		})
+		if err != nil {
+			return last, err
+		}
+		if done {
+			break
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return last, err
+	}
+	log.Printf("Restored wal records %d to %d into %s\r\n", after+1, last, segPath)
+	return last, fileutil.SyncDir(dir)
+}
+
+// 读取一个归档的段，apply 返回 false 时停止，此时返回 true
+// 归档的段在归档前已经回放过，遇到损坏的记录时停止恢复
+func readArchivedSegment(segPath string, apply func(Record) (bool, error)) (bool, error) {
+	f, err := os.Open(segPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	r := NewReader(f, info.Size())
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if errors.Is(err, ErrTruncated) || errors.Is(err, ErrCorrupted) {
+			log.Printf("%s: stop restoring, %v\r\n", segPath, err)
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		ok, err := apply(record)
+		if err != nil || !ok {
+			return true, err
+		}
+	}
+}
+
+// 将段移动到归档目录中，归档目录中已经有同一编号的段时返回 ErrArchived，不会覆盖它
+func archiveSegment(dir string, archiveDir string, num uint64) error {
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return err
+	}
+	src := segmentPath(dir, num)
+	dst := segmentPath(archiveDir, num)
+	// 硬链接在目标已经存在时失败，不在同一个文件系统时改为复制
+	err := os.Link(src, dst)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s", ErrArchived, dst)
+	}
+	if err != nil {
+		if _, err := os.Stat(dst); err == nil {
+			return fmt.Errorf("%w: %s", ErrArchived, dst)
+		}
+		if err := fileutil.CopyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(archiveDir)
+}
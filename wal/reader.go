@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+var (
+	// ErrTruncated 记录头或记录体不完整，之后的数据都无法读取
+	ErrTruncated = errors.New("wal: truncated record")
+	// ErrCorrupted 记录无法解析，但可以跳过它继续读取下一条
+	ErrCorrupted = errors.New("wal: corrupted record")
+	// ErrCorruptedTail 已经同步的段的尾部不完整或损坏，不是写入时崩溃造成的
+	ErrCorruptedTail = errors.New("wal: corrupted tail")
+)
+
+// 读取缓冲区大小
+const readBufferSize = 256 << 10
+
+// Record 一条 WAL 记录及其在段文件中的位置
+type Record struct {
+	// 记录在段文件中的起始位置
+	Offset int64
+	// 记录的总长度，包含记录头
+	Size int64
+	// 记录的序号，旧版本的记录为 0
+	Seq uint64
+	// 写入时间，旧版本的记录为零值
+	Time time.Time
+	// 记录使用的压缩算法
+	Compression compress.Type
+	KV          kv.KV
+}
+
+// Reader 顺序读取一个段文件中的记录，不会将整个文件加载到内存
+type Reader struct {
+	r *bufio.Reader
+	// 段文件的总长度
+	size int64
+	// 下一条记录的起始位置
+	offset int64
+	// 段文件的格式版本
+	version byte
+	// 段中第一条记录的序号
+	baseSeq uint64
+	err     error
+	// 当前这批写入中尚未返回的部分
+	batch   Record
+	pending []kv.KV
+}
+
+// NewReader 创建一个 Reader，size 为段文件的总长度
+func NewReader(r io.Reader, size int64) *Reader {
+	reader := &Reader{
+		r:       bufio.NewReaderSize(r, readBufferSize),
+		size:    size,
+		version: segmentVersionJSON,
+	}
+	// 读取文件头，没有文件头的是旧版本的段文件
+	if size >= segmentHeaderSize {
+		header, err := reader.r.Peek(segmentHeaderSize)
+		if err != nil {
+			reader.err = err
+		} else if string(header[:len(segmentMagic)]) == segmentMagic {
+			reader.readHeader(header[len(segmentMagic)])
+		}
+	}
+	return reader
+}
+
+// 读取新版本的文件头
+func (r *Reader) readHeader(version byte) {
+	r.version = version
+	if r.version > currentSegmentVersion {
+		r.err = fmt.Errorf("wal: unknown segment version %d", r.version)
+		return
+	}
+	headerLen := segmentHeaderLen(r.version)
+	if r.size < headerLen {
+		r.err = fmt.Errorf("%w: segment header", ErrTruncated)
+		return
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		r.err = err
+		return
+	}
+	if r.version >= segmentVersionSeq {
+		r.baseSeq = binary.LittleEndian.Uint64(header[segmentHeaderSize:])
+	}
+	r.offset = headerLen
+}
+
+// BaseSeq 返回段中第一条记录的序号，旧版本的段文件返回 0
+func (r *Reader) BaseSeq() uint64 {
+	return r.baseSeq
+}
+
+// Version 返回段文件的格式版本
+func (r *Reader) Version() int {
+	return int(r.version)
+}
+
+// Offset 返回下一条记录的起始位置
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Size 返回段文件的总长度
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Next 读取下一条记录，读完时返回 io.EOF
+// 一批写入被编码为一条记录时，逐条返回其中的写入，它们的 Offset 和 Size 相同
+// 返回 ErrTruncated 时 Reader 不能继续使用；返回 ErrCorrupted 时 Record 中带有记录的位置，可以继续读取
+func (r *Reader) Next() (Record, error) {
+	if len(r.pending) > 0 {
+		return r.nextPending()
+	}
+
+	record := Record{Offset: r.offset}
+	if r.err != nil {
+		return record, r.err
+	}
+	remaining := r.size - r.offset
+	if remaining == 0 {
+		return record, io.EOF
+	}
+	headerLen := recordHeaderLen(r.version)
+	if remaining < headerLen {
+		return record, fmt.Errorf("%w at offset %d", ErrTruncated, r.offset)
+	}
+
+	// 记录头：旧版本为8字节的长度，新版本为4字节长度 + 4字节校验和 (+ 1字节压缩算法)
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return record, err
+	}
+	var dataLen int64
+	var checksum uint32
+	if r.version == segmentVersionJSON {
+		dataLen = int64(binary.LittleEndian.Uint64(header))
+	} else {
+		dataLen = int64(binary.LittleEndian.Uint32(header[0:4]))
+		checksum = binary.LittleEndian.Uint32(header[4:8])
+	}
+	if dataLen < 0 || dataLen > remaining-headerLen {
+		return record, fmt.Errorf("%w at offset %d", ErrTruncated, r.offset)
+	}
+
+	// 将元素的所有字节读取出来 并还原为kv.KV
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return record, err
+	}
+	record.Size = headerLen + dataLen
+	r.offset += record.Size
+
+	if r.version >= segmentVersionBinary {
+		crc := crc32.Update(0, crcTable, header[recordHeaderSize:])
+		if crc32.Update(crc, crcTable, data) != checksum {
+			return record, fmt.Errorf("%w at offset %d: checksum mismatch", ErrCorrupted, record.Offset)
+		}
+	}
+
+	switch r.version {
+	case segmentVersionJSON, segmentVersionBinary:
+		format := kv.FormatJSON
+		if r.version == segmentVersionBinary {
+			format = kv.FormatBinary
+		}
+		value, err := kv.DecodeFormat(data, format)
+		if err != nil {
+			return record, fmt.Errorf("%w at offset %d: %v", ErrCorrupted, record.Offset, err)
+		}
+		record.KV = value
+		return record, nil
+	}
+
+	// 一批写入，先解压再逐条解码
+	record.Compression = compress.Type(header[recordHeaderSize])
+	if r.version >= segmentVersionSeq {
+		record.Seq = binary.LittleEndian.Uint64(header[recordHeaderSize+1:])
+		record.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(header[recordHeaderSize+9:])))
+	}
+	c, err := compress.Get(record.Compression)
+	if err != nil {
+		return record, fmt.Errorf("%w at offset %d: %v", ErrCorrupted, record.Offset, err)
+	}
+	if record.Compression != compress.None {
+		data, err = c.Decompress(nil, data)
+		if err != nil {
+			return record, fmt.Errorf("%w at offset %d: %v", ErrCorrupted, record.Offset, err)
+		}
+	}
+	var entries []kv.KV
+	for len(data) > 0 {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > uint64(len(data)-size) {
+			return record, fmt.Errorf("%w at offset %d: invalid batch", ErrCorrupted, record.Offset)
+		}
+		value, err := kv.Decode(data[size : size+int(n)])
+		if err != nil {
+			return record, fmt.Errorf("%w at offset %d: %v", ErrCorrupted, record.Offset, err)
+		}
+		entries = append(entries, value)
+		data = data[size+int(n):]
+	}
+	if len(entries) == 0 {
+		return record, fmt.Errorf("%w at offset %d: empty batch", ErrCorrupted, record.Offset)
+	}
+	r.batch = record
+	r.pending = entries
+	return r.nextPending()
+}
+
+// 返回一批写入中的下一条
+func (r *Reader) nextPending() (Record, error) {
+	record := r.batch
+	record.KV = r.pending[0]
+	r.pending = r.pending[1:]
+	if r.batch.Seq > 0 {
+		r.batch.Seq++
+	}
+	return record, nil
+}
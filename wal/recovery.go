@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"errors"
+	"io"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+)
+
+// 记录头的长度
+const recordHeaderSize = 8
+
+// RecoveryReport WAL 恢复的结果
+type RecoveryReport struct {
+	// 成功恢复的记录数
+	Records int
+	// 被丢弃的记录数
+	DroppedRecords int
+	// 被丢弃的字节数
+	DroppedBytes int64
+	// 读取的字节数
+	Size int64
+	// 恢复的最后一条写入的序号
+	LastSeq uint64
+}
+
+// 统计 Reader 中剩余的记录数
+func countRecords(r *Reader) int {
+	count := 0
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			return count
+		}
+		count++
+		if err != nil && !errors.Is(err, ErrCorrupted) {
+			return count
+		}
+	}
+}
+
+// 按照恢复策略回放 Reader 中的记录
+// 返回恢复结果，以及最后一条可以保留的记录的结束位置
+func replay(r *Reader, mode config.WALRecoveryMode, apply func(Record)) (RecoveryReport, int64, error) {
+	var report RecoveryReport
+	// 文件头总是保留
+	validLen := r.Offset()
+
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return report, validLen, nil
+		}
+		if errors.Is(err, ErrTruncated) {
+			// 记录头或记录体不完整，说明写入时发生了崩溃，只可能出现在尾部
+			if mode == config.WALAbsoluteConsistency {
+				return report, validLen, err
+			}
+			report.DroppedRecords++
+			report.DroppedBytes += r.Size() - record.Offset
+			return report, validLen, nil
+		}
+		if errors.Is(err, ErrCorrupted) {
+			next := record.Offset + record.Size
+			switch mode {
+			case config.WALAbsoluteConsistency:
+				return report, validLen, err
+			case config.WALTolerateCorruptedTailRecords:
+				if next != r.Size() {
+					return report, validLen, err
+				}
+				report.DroppedRecords++
+				report.DroppedBytes += r.Size() - record.Offset
+				return report, validLen, nil
+			case config.WALPointInTimeRecovery:
+				report.DroppedRecords += 1 + countRecords(r)
+				report.DroppedBytes += r.Size() - record.Offset
+				return report, validLen, nil
+			default:
+				// 跳过损坏的记录，继续读取下一条
+				report.DroppedRecords++
+				report.DroppedBytes += record.Size
+				validLen = next
+				continue
+			}
+		}
+		if err != nil {
+			// 读取文件失败
+			return report, validLen, err
+		}
+
+		apply(record)
+		report.Records++
+		if record.Seq > report.LastSeq {
+			report.LastSeq = record.Seq
+		}
+		validLen = record.Offset + record.Size
+	}
+}
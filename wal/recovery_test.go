@@ -0,0 +1,224 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/memtable"
+)
+
+func appendRecord(data []byte, value kv.KV) []byte {
+	body, _ := json.Marshal(value)
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(body)))
+	return append(data, body...)
+}
+
+func TestReplayRecoveryModes(t *testing.T) {
+	var good []byte
+	good = appendRecord(good, kv.KV{Key: "a", Value: []byte(`1`), Status: kv.StatusSuccess})
+	good = appendRecord(good, kv.KV{Key: "b", Value: []byte(`2`), Status: kv.StatusSuccess})
+
+	// 中间一条记录体被破坏
+	middle := append([]byte{}, good...)
+	middle = binary.LittleEndian.AppendUint64(middle, 3)
+	middle = append(middle, "xyz"...)
+	middle = appendRecord(middle, kv.KV{Key: "c", Value: []byte(`3`), Status: kv.StatusSuccess})
+
+	// 尾部记录只写了一半
+	tail := append([]byte{}, good...)
+	tail = binary.LittleEndian.AppendUint64(tail, 100)
+	tail = append(tail, "{\"Key\""...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		mode     config.WALRecoveryMode
+		wantErr  bool
+		records  int
+		dropped  int
+		validLen int
+	}{
+		{"tail/absolute", tail, config.WALAbsoluteConsistency, true, 2, 0, len(good)},
+		{"tail/tolerate", tail, config.WALTolerateCorruptedTailRecords, false, 2, 1, len(good)},
+		{"tail/point-in-time", tail, config.WALPointInTimeRecovery, false, 2, 1, len(good)},
+		{"middle/tolerate", middle, config.WALTolerateCorruptedTailRecords, true, 2, 0, len(good)},
+		{"middle/point-in-time", middle, config.WALPointInTimeRecovery, false, 2, 2, len(good)},
+		{"middle/skip", middle, config.WALSkipAnyCorruptedRecords, false, 3, 1, len(middle)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := memtable.NewTree()
+			r := NewReader(bytes.NewReader(tt.data), int64(len(tt.data)))
+			report, validLen, err := replay(r, tt.mode, func(record Record) {
+				tree.Put(record.KV.Key, record.KV.Value)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if report.Records != tt.records || report.DroppedRecords != tt.dropped {
+				t.Fatalf("report = %+v, want %d records, %d dropped", report, tt.records, tt.dropped)
+			}
+			if validLen != int64(tt.validLen) {
+				t.Fatalf("validLen = %d, want %d", validLen, tt.validLen)
+			}
+		})
+	}
+}
+
+func TestReplayChecksumMismatch(t *testing.T) {
+	flate, _ := compress.Get(compress.Flate)
+	seq := uint64(0)
+	record := func(values ...kv.KV) []byte {
+		entries := make([][]byte, len(values))
+		for i, value := range values {
+			entries[i] = encodeEntry(value)
+		}
+		data := encodeBatch(entries, seq+1, time.Now(), flate)
+		seq += uint64(len(values))
+		return data
+	}
+	data := segmentHeader(1)
+	data = append(data, record(kv.KV{Key: "a", Value: []byte(`1`), Status: kv.StatusSuccess})...)
+	corrupt := len(data) + int(recordHeaderLen(currentSegmentVersion)) + 1
+	data = append(data, record(kv.KV{Key: "b", Value: []byte(`2`), Status: kv.StatusSuccess})...)
+	data = append(data, record(
+		kv.KV{Key: "c", Value: bytes.Repeat([]byte(`"c"`), 100), Status: kv.StatusSuccess},
+		kv.KV{Key: "d", Status: kv.StatusDeleted},
+	)...)
+	data[corrupt] ^= 0xff
+
+	r := NewReader(bytes.NewReader(data), int64(len(data)))
+	if _, _, err := replay(r, config.WALTolerateCorruptedTailRecords, func(Record) {}); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+
+	var keys []string
+	r = NewReader(bytes.NewReader(data), int64(len(data)))
+	report, _, err := replay(r, config.WALSkipAnyCorruptedRecords, func(record Record) {
+		keys = append(keys, record.KV.Key)
+		// 只有足够大的一批写入才会被压缩
+		if want := record.KV.Key != "a"; (record.Compression == compress.Flate) != want {
+			t.Errorf("record %s compression = %d", record.KV.Key, record.Compression)
+		}
+	})
+	if err != nil || report.Records != 3 || report.DroppedRecords != 1 {
+		t.Fatalf("report = %+v, err = %v", report, err)
+	}
+	if strings.Join(keys, ",") != "a,c,d" {
+		t.Fatalf("replayed %v, want [a c d]", keys)
+	}
+}
+
+// 按时间点恢复时，某个段中间损坏之后的段都不能再回放
+func TestPointInTimeStopsLaterSegments(t *testing.T) {
+	config.Reset()
+	config.Init(config.Config{WALRecoveryMode: config.WALPointInTimeRecovery})
+	t.Cleanup(config.Reset)
+
+	dir := t.TempDir()
+	w := &Wal{}
+	w.Init(dir)
+	w.Write(kv.KV{Key: "a", Value: []byte(`1`), Status: kv.StatusSuccess})
+	info, err := os.Stat(segmentPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(kv.KV{Key: "b", Value: []byte(`2`), Status: kv.StatusSuccess})
+	w.Write(kv.KV{Key: "c", Value: []byte(`3`), Status: kv.StatusSuccess})
+	first := w.Rotate()
+	w.Write(kv.KV{Key: "d", Value: []byte(`4`), Status: kv.StatusSuccess})
+	second := w.Rotate()
+	_ = w.Close()
+
+	// 破坏第一个段中 b 的记录
+	data, err := os.ReadFile(segmentPath(dir, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[info.Size()+recordHeaderSize+2] ^= 0xff
+	if err := os.WriteFile(segmentPath(dir, first), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &Wal{}
+	tree := reopened.Init(dir)
+	defer reopened.Close()
+	if _, status := tree.Get("a"); status != kv.StatusSuccess {
+		t.Fatal("a is missing")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, status := tree.Get(key); status == kv.StatusSuccess {
+			t.Fatalf("%s was replayed after the corrupted record", key)
+		}
+	}
+	if _, err := os.Stat(segmentPath(dir, second)); !os.IsNotExist(err) {
+		t.Fatalf("segment %d was not dropped, err = %v", second, err)
+	}
+	if report := reopened.RecoveryReport(); report.Records != 1 || report.DroppedRecords != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+// 之前的段在切换时已经同步，尾部不完整时不能按照容忍尾部损坏处理
+func TestTolerateTailOnlyInLastSegment(t *testing.T) {
+	config.Reset()
+	t.Cleanup(config.Reset)
+
+	dir := t.TempDir()
+	w := &Wal{}
+	w.Init(dir)
+	w.Write(kv.KV{Key: "a", Value: []byte(`1`), Status: kv.StatusSuccess})
+	w.Write(kv.KV{Key: "b", Value: []byte(`2`), Status: kv.StatusSuccess})
+	first := w.Rotate()
+	w.Write(kv.KV{Key: "c", Value: []byte(`3`), Status: kv.StatusSuccess})
+	_ = w.Close()
+
+	data, err := os.ReadFile(segmentPath(dir, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segmentPath(dir, first), int64(len(data)-3)); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := &Wal{dir: dir, segments: segments}
+	if _, err := reopened.load(); !errors.Is(err, ErrCorruptedTail) {
+		t.Fatalf("err = %v, want %v", err, ErrCorruptedTail)
+	}
+
+	// 最后一个段的尾部不完整可以容忍
+	if err := os.WriteFile(segmentPath(dir, first), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	last := segments[len(segments)-1]
+	info, err := os.Stat(segmentPath(dir, last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segmentPath(dir, last), info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	reopened = &Wal{dir: dir, segments: segments}
+	tree, err := reopened.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := tree.Get("c"); status == kv.StatusSuccess {
+		t.Fatal("the torn record c was replayed")
+	}
+	if _, status := tree.Get("b"); status != kv.StatusSuccess {
+		t.Fatal("b is missing")
+	}
+}
@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+)
+
+// 旧版本的单文件 WAL，作为编号为 0 的段处理
+const legacyWalName = "wal.log"
+
+// 段文件头：魔数(4字节) + 格式版本(1字节) (+ 段中第一条记录的序号(8字节))，
+// 旧版本的段文件没有文件头
+const (
+	segmentMagic      = "TWAL"
+	segmentHeaderSize = 5
+)
+
+// 段文件的格式版本
+const (
+	// 没有文件头，记录为 8字节长度 + JSON
+	segmentVersionJSON = 1
+	// 记录为 4字节长度 + 4字节 CRC32C + 二进制编码的 kv.KV
+	segmentVersionBinary = 2
+	// 记录为 4字节长度 + 4字节 CRC32C + 1字节压缩算法 + 一批写入，
+	// 解压后的每条写入为 varint 长度 + 二进制编码的 kv.KV
+	segmentVersionBatch = 3
+	// 记录头中增加 8字节序号 + 8字节时间戳，一批写入的序号连续；文件头中增加第一条记录的序号
+	segmentVersionSeq = 4
+
+	currentSegmentVersion = segmentVersionSeq
+)
+
+// VersionChecksum 从这个版本开始，每条记录都带有 CRC32C 校验和
+const VersionChecksum = segmentVersionBinary
+
+// 记录的校验和使用 CRC32C
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 不同版本的记录头长度
+func recordHeaderLen(version byte) int64 {
+	switch {
+	case version >= segmentVersionSeq:
+		return recordHeaderSize + 1 + 8 + 8
+	case version >= segmentVersionBatch:
+		return recordHeaderSize + 1
+	}
+	return recordHeaderSize
+}
+
+// 不同版本的文件头长度
+func segmentHeaderLen(version byte) int64 {
+	if version >= segmentVersionSeq {
+		return segmentHeaderSize + 8
+	}
+	return segmentHeaderSize
+}
+
+// 编码一条写入，作为一批写入中的一项
+func encodeEntry(value kv.KV) []byte {
+	n := kv.EncodedLen(value)
+	data := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen32+n), uint64(n))
+	return kv.AppendEncode(data, value)
+}
+
+// 将一批写入编码为一条当前格式的记录，seq 为第一条写入的序号，压缩后没有变小则不压缩
+func encodeBatch(entries [][]byte, seq uint64, ts time.Time, c compress.Compressor) []byte {
+	size := 0
+	for _, entry := range entries {
+		size += len(entry)
+	}
+	payload := make([]byte, 0, size)
+	for _, entry := range entries {
+		payload = append(payload, entry...)
+	}
+
+	codec := compress.None
+	if c != nil && c.Type() != compress.None {
+		compressed, err := c.Compress(nil, payload)
+		if err == nil && len(compressed) < len(payload) {
+			payload = compressed
+			codec = c.Type()
+		}
+	}
+
+	headerLen := recordHeaderLen(currentSegmentVersion)
+	data := make([]byte, headerLen, headerLen+int64(len(payload)))
+	data[recordHeaderSize] = byte(codec)
+	binary.LittleEndian.PutUint64(data[recordHeaderSize+1:], seq)
+	binary.LittleEndian.PutUint64(data[recordHeaderSize+9:], uint64(ts.UnixNano()))
+	data = append(data, payload...)
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:8], crc32.Checksum(data[recordHeaderSize:], crcTable))
+	return data
+}
+
+// 段文件头，seq 为段中第一条记录的序号
+func segmentHeader(seq uint64) []byte {
+	header := append([]byte(segmentMagic), currentSegmentVersion)
+	return binary.LittleEndian.AppendUint64(header, seq)
+}
+
+// 段文件名，例如 000001.log
+func segmentName(num uint64) string {
+	if num == 0 {
+		return legacyWalName
+	}
+	return fmt.Sprintf("%06d.log", num)
+}
+
+func segmentPath(dir string, num uint64) string {
+	return path.Join(dir, segmentName(num))
+}
+
+// 从段文件名中解析段编号
+func parseSegmentName(name string) (uint64, bool) {
+	if name == legacyWalName {
+		return 0, true
+	}
+	var num uint64
+	n, err := fmt.Sscanf(name, "%d.log", &num)
+	if n != 1 || err != nil || segmentName(num) != name {
+		return 0, false
+	}
+	return num, true
+}
+
+// 列出目录中所有的段编号，升序排列
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if num, ok := parseSegmentName(entry.Name()); ok {
+			segments = append(segments, num)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
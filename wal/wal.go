@@ -15,15 +15,16 @@
 package wal
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"sync"
 	"time"
 
+	"github.com/lvtuwjl/tungdb/tung/compress"
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/internal/fileutil"
 	"github.com/lvtuwjl/tungdb/tung/kv"
 	"github.com/lvtuwjl/tungdb/tung/memtable"
 )
@@ -31,143 +32,425 @@ import (
 // Wal crash recovery
 // memory table => wal
 // start load wal => memory table
+//
+// WAL 由编号递增的段文件组成，每一代内存表对应一个新的段，
+// 段中的数据被持久化到 SSTable 后，才能删除该段
 type Wal struct {
+	dir string
+	// 当前写入的段
 	file *os.File
-	path string
-	mu   sync.Mutex
+	num  uint64
+	// 尚未删除的段编号，升序排列，最后一个为当前写入的段
+	segments []uint64
+	mu       sync.Mutex
+	// 最近一次恢复的结果
+	report RecoveryReport
+
+	// OnProgress 回放进度回调，为空时定期打印日志
+	OnProgress func(ReplayProgress)
+	// OnFlush 回放时内存表达到阈值后调用，由调用方持久化内存表；为空时不会提前持久化
+	OnFlush func(tree memtable.Memtable)
+
+	// 组提交队列，队首的写入者负责把整个队列一次性写入文件
+	queue []*writer
+	qmu   sync.Mutex
+	cond  *sync.Cond
+	// 写入时使用的压缩算法
+	compressor compress.Compressor
+	// 最后一条写入的序号
+	seq uint64
+	// 归档目录，为空时直接删除持久化后的段
+	archiveDir string
 }
 
-func (w *Wal) Init(dir string) *memtable.Tree {
-	log.Println("Loading wal.log...")
+// 一个等待提交的写入
+type writer struct {
+	data []byte
+	done bool
+}
+
+// 一次组提交最多合并的字节数
+const maxBatchSize = 1 << 20
+
+// 回放时每读取这么多字节报告一次进度
+var progressInterval int64 = 16 << 20
+
+// ReplayProgress WAL 回放进度
+type ReplayProgress struct {
+	// 正在回放的段编号
+	Segment uint64
+	// 已回放的记录数
+	Records int
+	// 已读取的字节数
+	Bytes int64
+	// 所有段的总字节数
+	TotalBytes int64
+	// 回放过程中提前持久化的内存表数量
+	Flushes int
+}
+
+func (w *Wal) Init(dir string) memtable.Memtable {
+	log.Println("Loading wal...")
 	start := time.Now()
 	defer func() {
 		elapse := time.Since(start)
-		log.Println("Loaded wal.log, Consumption od time:", elapse)
+		log.Println("Loaded wal, Consumption od time:", elapse)
 	}()
 
-	walPath := path.Join(dir, "wal.log")
-	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	w.dir = dir
+	w.mu = sync.Mutex{}
+	w.cond = sync.NewCond(&w.qmu)
+	compressor, err := compress.Get(config.GetConfig().WALCompression)
 	if err != nil {
-		log.Fatalln("The wal.log file cannot be created")
+		log.Fatalln("Failed to load the wal compressor,", err)
+	}
+	w.compressor = compressor
+	w.archiveDir = config.GetConfig().WALArchiveDir
+	segments, err := listSegments(dir)
+	if err != nil {
+		log.Fatalln("Failed to read the wal segments,", err)
+	}
+	w.segments = segments
+	// 为新的写入创建一个新的段，已有的段需要等内存表持久化后再删除
+	// 回放时可能丢弃之后的段，新的段不能复用它们的编号
+	next := uint64(1)
+	if n := len(segments); n > 0 {
+		next = segments[n-1] + 1
 	}
+	tree := w.LoadToMemory()
 
-	w.file = f
-	w.path = walPath
-	w.mu = sync.Mutex{}
-	return w.LoadToMemory()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.openSegment(next)
+	return tree
+}
+
+// LoadToMemory 按顺序回放所有的段文件,加载到内存
+// 遇到损坏的记录时，按照配置的 WALRecoveryMode 处理：只有最后一个段可能在写入时崩溃，
+// 之前的段在 Rotate 时已经同步，尾部损坏也不能容忍；按时间点恢复时，损坏之后的段都不再回放。
+// 设置了 OnFlush 时，内存表超过阈值会先持久化，再继续回放到新的内存表中
+func (w *Wal) LoadToMemory() memtable.Memtable {
+	tree, err := w.load()
+	if err != nil {
+		log.Fatalln("Failed to load the wal,", err)
+	}
+	return tree
 }
 
-// LoadToMemory 通过wal.log文件初始化Wal,加载文件到内存
-func (w *Wal) LoadToMemory() *memtable.Tree {
+func (w *Wal) load() (memtable.Memtable, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	info, _ := os.Stat(w.path)
-	size := info.Size()
-	tree := memtable.NewTree()
+	con := config.GetConfig()
+	tree := memtable.New(con.MemtableType)
+	w.report = RecoveryReport{}
+	progress := ReplayProgress{TotalBytes: w.totalSize()}
+	reported := int64(0)
+
+	segments := make([]uint64, 0, len(w.segments))
+	stopped := false
+	for i, num := range w.segments {
+		progress.Segment = num
+		base := progress.Bytes
+		segPath := segmentPath(w.dir, num)
+		if stopped {
+			// 之前的段中有损坏的记录，之后的写入不再连续，丢弃整个段
+			report, err := dropSegment(segPath)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("%s: recovery mode %s dropped the segment, %d records (%d bytes)\r\n",
+				segPath, con.WALRecoveryMode, report.DroppedRecords, report.DroppedBytes)
+			w.report.DroppedRecords += report.DroppedRecords
+			w.report.DroppedBytes += report.DroppedBytes
+			w.report.Size += report.Size
+			progress.Bytes = base + report.Size
+			continue
+		}
+		segments = append(segments, num)
+		last := i == len(w.segments)-1
+		report, err := w.loadSegment(segPath, con.WALRecoveryMode, last, func(record Record) {
+			value := record.KV
+			if value.Status == kv.StatusDeleted {
+				tree.Delete(value.Key)
+			} else {
+				tree.Put(value.Key, value.Value)
+			}
+			progress.Records++
+			progress.Bytes = base + record.Offset + record.Size
 
-	// 空的 wal.log
-	if size == 0 {
-		return tree
+			// 回放的数据超过内存表的阈值，提前持久化
+			if w.OnFlush != nil && (con.Threshold > 0 || con.MemtableSize > 0) &&
+				memtable.Full(tree, con.Threshold, con.MemtableSize) {
+				w.OnFlush(tree)
+				tree = memtable.New(con.MemtableType)
+				progress.Flushes++
+			}
+			if progress.Bytes-reported >= progressInterval {
+				reported = progress.Bytes
+				w.reportProgress(progress)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if report.DroppedRecords > 0 {
+			log.Printf("%s: recovery mode %s dropped %d records (%d bytes)\r\n",
+				segPath, con.WALRecoveryMode, report.DroppedRecords, report.DroppedBytes)
+			stopped = con.WALRecoveryMode == config.WALPointInTimeRecovery
+		}
+		w.report.Records += report.Records
+		w.report.DroppedRecords += report.DroppedRecords
+		w.report.DroppedBytes += report.DroppedBytes
+		w.report.Size += report.Size
+		if report.LastSeq > w.report.LastSeq {
+			w.report.LastSeq = report.LastSeq
+		}
+		progress.Bytes = base + report.Size
+	}
+	if len(w.segments) > 0 {
+		w.reportProgress(progress)
 	}
+	w.segments = segments
+	w.seq = w.report.LastSeq
+	return tree, nil
+}
 
-	_, err := w.file.Seek(0, 0)
+// 回放一个段文件，使用带缓冲的 Reader 逐条读取，last 表示是否为最后一个段
+func (w *Wal) loadSegment(segPath string, mode config.WALRecoveryMode, last bool, apply func(Record)) (RecoveryReport, error) {
+	f, err := os.OpenFile(segPath, os.O_RDWR, 0666)
 	if err != nil {
-		log.Fatalln("Failed to open the wal.log")
+		return RecoveryReport{}, err
 	}
+	defer f.Close()
 
-	// 文件指针移动到最后,方便追加
-	defer func(f *os.File, offset int64, whence int) {
-		_, err := f.Seek(offset, whence)
-		if err != nil {
-			log.Fatalln("Failed to open the wal.log")
-		}
-	}(w.file, size-1, 0)
+	info, err := f.Stat()
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	size := info.Size()
 
-	// 将文件内容全部读取到内存
-	data := make([]byte, size)
-	_, err = w.file.Read(data)
+	r := NewReader(f, size)
+	report, validLen, err := replay(r, mode, apply)
 	if err != nil {
-		log.Fatalln("Failed to open the wal.log")
+		return report, fmt.Errorf("%s: recovery mode %s: %w", segPath, mode, err)
+	}
+	report.Size = size
+	// 之前的段在切换时已经同步，尾部不完整说明数据已经损坏
+	if !last && report.DroppedRecords > 0 && mode == config.WALTolerateCorruptedTailRecords {
+		return report, fmt.Errorf("%s: recovery mode %s: %w in a non-final segment", segPath, mode, ErrCorruptedTail)
+	}
+	// 段中没有记录时，由文件头得到之前的序号
+	if r.BaseSeq() > 0 && r.BaseSeq()-1 > report.LastSeq {
+		report.LastSeq = r.BaseSeq() - 1
 	}
 
-	dataLen := int64(0)
-	index := int64(0)
-	for index < size {
-		// 前面的8个字节表示元素的长度
-		indexData := data[index : index+8]
-		// 获取元素的字节长度
-		buf := bytes.NewBuffer(indexData)
-		err := binary.Read(buf, binary.LittleEndian, &dataLen)
-		if err != nil {
-			log.Fatalln("Failed to open the wal.log")
+	// 截掉尾部不完整的数据，否则后续追加的记录将无法被读取
+	if validLen < size {
+		if err := f.Truncate(validLen); err != nil {
+			return report, err
 		}
+	}
+	return report, nil
+}
 
-		// 将元素的所有字节读取出来 并还原为kv.KV
-		index += 8
-		dataArea := data[index : index+dataLen]
-		var value kv.KV
-		err = json.Unmarshal(dataArea, &value)
-		if err != nil {
-			log.Fatalln("Failed to open the wal.log")
-		}
+// 删除一个不再回放的段，返回其中被丢弃的记录
+func dropSegment(segPath string) (RecoveryReport, error) {
+	f, err := os.Open(segPath)
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return RecoveryReport{}, err
+	}
+	report := RecoveryReport{
+		DroppedRecords: countRecords(NewReader(f, info.Size())),
+		DroppedBytes:   info.Size(),
+		Size:           info.Size(),
+	}
+	_ = f.Close()
+	return report, os.Remove(segPath)
+}
 
-		if value.Status == kv.StatusDeleted {
-			tree.Delete(value.Key)
-		} else {
-			tree.Put(value.Key, value.Value)
+// 所有段文件的总长度
+func (w *Wal) totalSize() int64 {
+	total := int64(0)
+	for _, num := range w.segments {
+		info, err := os.Stat(segmentPath(w.dir, num))
+		if err == nil {
+			total += info.Size()
 		}
+	}
+	return total
+}
 
-		// 读取下一个元素
-		index = index + dataLen
+func (w *Wal) reportProgress(progress ReplayProgress) {
+	if w.OnProgress != nil {
+		w.OnProgress(progress)
+		return
 	}
-	return tree
+	log.Printf("Replaying wal segment %d: %d records, %d/%d bytes\r\n",
+		progress.Segment, progress.Records, progress.Bytes, progress.TotalBytes)
 }
 
-func (w *Wal) Write(value kv.KV) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// RecoveryReport 返回最近一次加载 WAL 的恢复结果
+func (w *Wal) RecoveryReport() RecoveryReport {
+	return w.report
+}
 
+// Write 写入一条记录，返回时记录已经写入文件
+// 并发的写入者进入队列，由队首的写入者合并后一次写入并 fsync，再统一通知其余写入者
+func (w *Wal) Write(value kv.KV) {
 	if value.Status == kv.StatusDeleted {
-		log.Println("wal.log: delete ", value.Key)
+		log.Println("wal: delete ", value.Key)
 	} else {
-		log.Fatalln("wal.log: insert ", value.Key)
+		log.Println("wal: insert ", value.Key)
 	}
 
-	data, _ := json.Marshal(value)
-	err := binary.Write(w.file, binary.LittleEndian, int64(len(data)))
-	if err != nil {
-		log.Fatalln("Failed to write the wal.log")
+	wr := &writer{data: encodeEntry(value)}
+	w.qmu.Lock()
+	w.queue = append(w.queue, wr)
+	for !wr.done && wr != w.queue[0] {
+		w.cond.Wait()
+	}
+	// 已经被其他写入者提交
+	if wr.done {
+		w.qmu.Unlock()
+		return
 	}
 
-	err = binary.Write(w.file, binary.LittleEndian, data)
-	if err != nil {
-		log.Fatalln("Failed to write the wal.log")
+	// 成为队首，将队列中的写入合并为一条记录
+	size := 0
+	n := 0
+	for n < len(w.queue) && (n == 0 || size+len(w.queue[n].data) <= maxBatchSize) {
+		size += len(w.queue[n].data)
+		n++
+	}
+	batch := w.queue[:n]
+	w.qmu.Unlock()
+
+	entries := make([][]byte, n)
+	for i, b := range batch {
+		entries[i] = b.data
 	}
+	w.commit(entries)
+
+	w.qmu.Lock()
+	for _, b := range batch {
+		b.done = true
+	}
+	w.queue = w.queue[n:]
+	w.cond.Broadcast()
+	w.qmu.Unlock()
 }
 
-func (w *Wal) Reset() {
+// 为合并后的写入分配序号，编码为一条记录写入当前的段
+func (w *Wal) commit(entries [][]byte) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	log.Println("Resetting the wal.log file")
-	err := w.file.Close()
+	buf := encodeBatch(entries, w.seq+1, time.Now(), w.compressor)
+	w.seq += uint64(len(entries))
+	_, err := w.file.Write(buf)
 	if err != nil {
-		panic(err)
+		log.Fatalln("Failed to write the wal,", err)
+	}
+	if config.GetConfig().WALSync {
+		err = w.file.Sync()
+		if err != nil {
+			log.Fatalln("Failed to sync the wal,", err)
+		}
 	}
+}
 
+// Rotate 关闭当前的段并创建一个新的段，返回被关闭的段编号
+// 需要与内存表的交换同时进行，之后的写入都属于新的内存表
+func (w *Wal) Rotate() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	old := w.num
+	if err := w.file.Sync(); err != nil {
+		log.Fatalln("Failed to sync the wal,", err)
+	}
+	if err := w.file.Close(); err != nil {
+		log.Fatalln("Failed to close the wal,", err)
+	}
 	w.file = nil
-	err = os.Remove(w.path)
-	if err != nil {
-		panic(err)
+	w.openSegment(old + 1)
+	return old
+}
+
+// Reset 删除编号不超过 num 的段，这些段的数据必须已经持久化到 SSTable 中
+// 配置了归档目录时，段被移动到归档目录中，用于按时间点恢复
+func (w *Wal) Reset(num uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments := make([]uint64, 0, len(w.segments))
+	for _, n := range w.segments {
+		if n > num || n == w.num {
+			segments = append(segments, n)
+			continue
+		}
+		if w.archiveDir != "" {
+			log.Println("Archiving the wal segment", n)
+			err := archiveSegment(w.dir, w.archiveDir, n)
+			if err != nil {
+				panic(err)
+			}
+			continue
+		}
+		log.Println("Removing the wal segment", n)
+		err := os.Remove(segmentPath(w.dir, n))
+		if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
 	}
+	w.segments = segments
+}
 
-	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		panic(err)
+// LastSeq 返回最后一条写入的序号
+func (w *Wal) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// CopySegments 将尚未删除的段复制到 dir 中，返回复制的最后一条写入的序号
+func (w *Wal) CopySegments(dir string) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, n := range w.segments {
+		name := segmentName(n)
+		err := fileutil.CopyFile(path.Join(w.dir, name), path.Join(dir, name))
+		if err != nil {
+			return 0, err
+		}
 	}
+	return w.seq, nil
+}
 
+// 创建并打开一个新的段，调用方需持有 w.mu
+func (w *Wal) openSegment(num uint64) {
+	segPath := segmentPath(w.dir, num)
+	f, err := os.OpenFile(segPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalln("The wal segment cannot be created,", segPath)
+	}
+	if _, err := f.Write(segmentHeader(w.seq + 1)); err != nil {
+		log.Fatalln("The wal segment cannot be created,", segPath)
+	}
+	// 确保新的段文件在崩溃后仍然存在
+	if err := fileutil.SyncDir(w.dir); err != nil {
+		log.Fatalln("Failed to sync the data directory,", err)
+	}
 	w.file = f
+	w.num = num
+	w.segments = append(w.segments, num)
 }
 
 func (w *Wal) Close() error {
@@ -0,0 +1,281 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lvtuwjl/tungdb/tung/config"
+	"github.com/lvtuwjl/tungdb/tung/kv"
+	"github.com/lvtuwjl/tungdb/tung/memtable"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	w := &Wal{}
+	w.Init(dir)
+
+	// 阻塞第一次提交，让其余 15 个写入者在队列中等待，之后它们必然合并为一条记录
+	w.mu.Lock()
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				w.Write(kv.KV{
+					Key:    fmt.Sprintf("%02d-%03d", g, i),
+					Value:  []byte(`1`),
+					Status: kv.StatusSuccess,
+				})
+			}
+		}(g)
+	}
+	for {
+		w.qmu.Lock()
+		queued := len(w.queue)
+		w.qmu.Unlock()
+		if queued == 16 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.mu.Unlock()
+	wg.Wait()
+	_ = w.Close()
+
+	// 同一批次的写入共享一条记录，记录数即提交和 fsync 的次数
+	batches := 0
+	data, err := os.ReadFile(segmentPath(dir, w.num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(bytes.NewReader(data), int64(len(data)))
+	offset := int64(-1)
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Offset != offset {
+			offset = record.Offset
+			batches++
+		}
+	}
+	if batches > 1600-14 {
+		t.Fatalf("%d batches for 1600 writes, nothing was grouped", batches)
+	}
+
+	reopened := &Wal{}
+	tree := reopened.Init(dir)
+	defer reopened.Close()
+	if tree.Size() != 1600 {
+		t.Fatalf("replayed %d keys, want 1600", tree.Size())
+	}
+	if report := reopened.RecoveryReport(); report.Records != 1600 || report.DroppedRecords != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func writeKeys(w *Wal, keys ...string) {
+	for _, key := range keys {
+		w.Write(kv.KV{Key: key, Value: []byte(`1`), Status: kv.StatusSuccess})
+	}
+}
+
+func TestResetFlushedSegments(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("archive=%v", archive), func(t *testing.T) {
+			dir := t.TempDir()
+			archiveDir := ""
+			if archive {
+				archiveDir = path.Join(t.TempDir(), "archive")
+			}
+			config.Reset()
+			config.Init(config.Config{WALArchiveDir: archiveDir})
+			t.Cleanup(config.Reset)
+
+			w := &Wal{}
+			w.Init(dir)
+			defer w.Close()
+			writeKeys(w, "a")
+			first := w.Rotate()
+			writeKeys(w, "b")
+			second := w.Rotate()
+			writeKeys(w, "c")
+
+			// 只有第一个段的数据已经持久化
+			w.Reset(first)
+			segments, _ := listSegments(dir)
+			if want := []uint64{second, w.num}; !reflect.DeepEqual(segments, want) {
+				t.Fatalf("segments = %v, want %v", segments, want)
+			}
+			if archive {
+				archived, _ := listSegments(archiveDir)
+				if want := []uint64{first}; !reflect.DeepEqual(archived, want) {
+					t.Fatalf("archived = %v, want %v", archived, want)
+				}
+			}
+
+			// 当前正在写入的段不会被删除
+			w.Reset(w.num)
+			segments, _ = listSegments(dir)
+			if want := []uint64{w.num}; !reflect.DeepEqual(segments, want) {
+				t.Fatalf("segments = %v, want %v", segments, want)
+			}
+			writeKeys(w, "d")
+			if w.LastSeq() != 4 {
+				t.Fatalf("last seq = %d, want 4", w.LastSeq())
+			}
+		})
+	}
+}
+
+// Rotate 创建新段时崩溃，新的段可能为空或只写入了一部分段头
+func TestReopenAfterCrashDuringRotate(t *testing.T) {
+	for _, partial := range []int{0, 3, len(segmentHeader(1)) - 1} {
+		t.Run(fmt.Sprintf("header=%d", partial), func(t *testing.T) {
+			config.Reset()
+			t.Cleanup(config.Reset)
+
+			dir := t.TempDir()
+			w := &Wal{}
+			w.Init(dir)
+			writeKeys(w, "a", "b")
+			first := w.Rotate()
+			writeKeys(w, "c")
+			_ = w.Close()
+
+			header := segmentHeader(4)
+			err := os.WriteFile(segmentPath(dir, first+2), header[:partial], 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := &Wal{}
+			tree := reopened.Init(dir)
+			if tree.Size() != 3 {
+				t.Fatalf("replayed %d keys, want 3", tree.Size())
+			}
+			if reopened.num != first+3 || reopened.LastSeq() != 3 {
+				t.Fatalf("segment = %d, last seq = %d", reopened.num, reopened.LastSeq())
+			}
+			writeKeys(reopened, "d")
+			_ = reopened.Close()
+
+			again := &Wal{}
+			tree = again.Init(dir)
+			defer again.Close()
+			if tree.Size() != 4 {
+				t.Fatalf("replayed %d keys, want 4", tree.Size())
+			}
+		})
+	}
+}
+
+// 回放时内存表达到阈值后提前持久化，并按读取的字节数报告进度
+func TestReplayFlushAndProgress(t *testing.T) {
+	config.Reset()
+	config.Init(config.Config{Threshold: 10})
+	t.Cleanup(config.Reset)
+	interval := progressInterval
+	progressInterval = 256
+	t.Cleanup(func() { progressInterval = interval })
+
+	dir := t.TempDir()
+	w := &Wal{}
+	w.Init(dir)
+	for i := 0; i < 100; i++ {
+		writeKeys(w, fmt.Sprintf("key-%03d", i))
+		if i == 49 {
+			w.Rotate()
+		}
+	}
+	_ = w.Close()
+
+	var flushed []memtable.Memtable
+	var progress []ReplayProgress
+	reopened := &Wal{
+		OnFlush:    func(tree memtable.Memtable) { flushed = append(flushed, tree) },
+		OnProgress: func(p ReplayProgress) { progress = append(progress, p) },
+	}
+	tree := reopened.Init(dir)
+	defer reopened.Close()
+
+	if len(flushed) == 0 {
+		t.Fatal("OnFlush was not called")
+	}
+	if report := reopened.RecoveryReport(); report.Records != 100 {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(progress) < 2 {
+		t.Fatalf("progress reported %d times", len(progress))
+	}
+	for i := 1; i < len(progress); i++ {
+		prev, cur := progress[i-1], progress[i]
+		if cur.Bytes < prev.Bytes || cur.Records < prev.Records || cur.Segment < prev.Segment {
+			t.Fatalf("progress went backwards: %+v after %+v", cur, prev)
+		}
+	}
+	last := progress[len(progress)-1]
+	if last.Bytes <= progress[0].Bytes {
+		t.Fatalf("progress did not advance: %+v", progress)
+	}
+	if last.Bytes != last.TotalBytes || last.Records != 100 || last.Flushes != len(flushed) {
+		t.Fatalf("final progress = %+v, %d flushes", last, len(flushed))
+	}
+
+	// 提前持久化的内存表和最终的内存表一起包含所有的数据
+	trees := append(flushed, tree)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		found := false
+		for _, tree := range trees {
+			if _, status := tree.Get(key); status == kv.StatusSuccess {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("%s is missing after replay", key)
+		}
+	}
+}
+
+// 归档目录中已经有同一编号的段时不能覆盖，按时间点恢复依赖其中的历史
+func TestArchiveSameSegmentTwice(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := path.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(segmentPath(dir, 1), []byte("first"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveSegment(dir, archiveDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(segmentPath(dir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("the archived segment was not removed, err = %v", err)
+	}
+
+	if err := os.WriteFile(segmentPath(dir, 1), []byte("second"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveSegment(dir, archiveDir, 1); !errors.Is(err, ErrArchived) {
+		t.Fatalf("archiveSegment() = %v, want %v", err, ErrArchived)
+	}
+	if data, _ := os.ReadFile(segmentPath(archiveDir, 1)); string(data) != "first" {
+		t.Fatalf("the archived segment was overwritten with %q", data)
+	}
+	if data, _ := os.ReadFile(segmentPath(dir, 1)); string(data) != "second" {
+		t.Fatalf("the segment was removed without being archived: %q", data)
+	}
+}